@@ -8,6 +8,9 @@ import (
 	"auth"
 	"auth/sessions"
 	"auth/u2f"
+	"cron"
+	"events"
+	"keyserver"
 	"keystore"
 	"users"
 	"vault"
@@ -17,6 +20,7 @@ var e = createMux()
 
 func init() {
 	e.GET("/api/logout", sessions.LogoutHandler, sessions.SessionsMiddleware)
+	e.GET("/api/events", events.StreamHandler, auth.AuthReadMiddlewares...)
 
 	usersGroup := e.Group("/api/users")
 	usersGroup.POST("", users.RegisterHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware)
@@ -24,28 +28,64 @@ func init() {
 	usersGroup.POST("/login", users.LoginHandler, auth.AuthWriteFallBackToReadMiddlewares...)
 	usersGroup.GET("/verify/:userKey", users.VerifyUserHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware)
 	usersGroup.POST("/verify/resend", users.ResendVerificationHandler, auth.AuthReadMiddlewares...)
+	usersGroup.PUT("/password", users.ChangePasswordHandler, auth.AuthWriteMiddlewares...)
+	usersGroup.POST("/password/reset", users.RequestPasswordResetHandler)
+	usersGroup.POST("/password/reset/confirm", users.ResetPasswordHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware, auth.SessionValidMiddleware)
+	usersGroup.PUT("/email", users.ChangeEmailHandler, auth.AuthWriteMiddlewares...)
+	usersGroup.GET("/email/verify/:token", users.VerifyEmailChangeHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware)
+	usersGroup.PUT("/publish", users.PublishKeysHandler, auth.AuthWriteMiddlewares...)
 
 	vaultGroup := e.Group("/api/vault")
 	vaultGroup.POST("", vault.PostHandler, auth.AuthWriteMiddlewares...)
 	vaultGroup.GET("", vault.GetAllHandler, auth.AuthReadMiddlewares...)
+	vaultGroup.GET("/changes", vault.ChangesHandler, auth.AuthReadMiddlewares...)
+	vaultGroup.GET("/stale", vault.StaleHandler, auth.AuthReadMiddlewares...)
+	vaultGroup.GET("/rotation", vault.GetRotationPolicyHandler, auth.AuthReadMiddlewares...)
+	vaultGroup.PUT("/rotation", vault.PutRotationPolicyHandler, auth.AuthWriteMiddlewares...)
 	vaultGroup.DELETE("/:title", vault.DeleteByTitleHandler, auth.AuthWriteMiddlewares...)
 
 	u2fGroup := e.Group("/api/u2f")
 	u2fGroup.GET("/register", u2f.RegisterRequestHandler, auth.AuthWriteMiddlewares...)
 	u2fGroup.POST("/register", u2f.RegisterResponseHandler, auth.AuthWriteMiddlewares...)
 	u2fGroup.GET("/sign", u2f.SignRequestHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware, auth.AddUserKeyMiddleware)
-	u2fGroup.POST("/sign", u2f.SignResponseHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware, auth.AddUserKeyMiddleware, auth.VerifyU2fInProgress)
+	u2fGroup.POST("/sign", u2f.SignResponseHandler, sessions.SessionsMiddleware, sessions.SessionProcessingMiddleware, auth.SessionValidMiddleware, auth.AddUserKeyMiddleware, auth.VerifyU2fInProgress)
 	u2fGroup.GET("/registrations", u2f.GetRegistrationsHandler, auth.AuthReadMiddlewares...)
 	u2fGroup.DELETE("/registrations/:id", u2f.DeleteRegistrationHandler, auth.AuthWriteMiddlewares...)
 	u2fGroup.PUT("/required", u2f.EnableDisableHandler, auth.AuthWriteMiddlewares...)
 
 	keyGroup := e.Group("/api/keys")
 	keyGroup.GET("", keystore.GetAllHandler, auth.AuthReadMiddlewares...)
+	keyGroup.GET("/expiring", keystore.ExpiringHandler, auth.AuthReadMiddlewares...)
+	keyGroup.GET("/export", keystore.ExportHandler, auth.AuthReadMiddlewares...)
+	keyGroup.GET("/discover", keystore.DiscoverHandler, auth.AuthReadMiddlewares...)
 	keyGroup.GET("/:id", keystore.GetHandler, auth.AuthReadMiddlewares...)
 	keyGroup.GET("/password/:name", keystore.GetPasswordPrivateKeyHandler, auth.AuthReadMiddlewares...)
-	keyGroup.GET("/proxy", keystore.ProxyHandler)
+	keyGroup.PUT("/password/:name", keystore.PutPasswordPrivateKeyHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.POST("/password/:name/rollback", keystore.RollbackPasswordPrivateKeyHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.GET("/proxy", keystore.ProxyHandler, auth.AuthReadMiddlewares...)
 	keyGroup.POST("", keystore.PostHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.POST("/import", keystore.ImportHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.POST("/:id/attestation", keystore.AttestationHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.POST("/:id/revocation", keystore.RevocationHandler, auth.AuthWriteMiddlewares...)
+	keyGroup.PATCH("/:id", keystore.PatchHandler, auth.AuthWriteMiddlewares...)
 	keyGroup.DELETE("/:id", keystore.RevokeHandler, auth.AuthWriteMiddlewares...)
+
+	wkdGroup := e.Group("/.well-known/openpgpkey", keyserver.CORSMiddleware)
+	wkdGroup.GET("/policy", keyserver.PolicyHandler)
+	wkdGroup.GET("/hu/:hash", keyserver.WKDHandler)
+	wkdGroup.GET("/:domain/policy", keyserver.PolicyHandler)
+	wkdGroup.GET("/:domain/hu/:hash", keyserver.AdvancedWKDHandler)
+
+	e.GET("/pks/lookup", keyserver.LookupHandler, keyserver.CORSMiddleware)
+
+	cronGroup := e.Group("/api/cron", auth.CronMiddleware)
+	cronGroup.GET("/stale-digest", cron.StaleDigestHandler)
+	cronGroup.GET("/key-expiry", cron.KeyExpiryHandler)
+	cronGroup.GET("/refresh-keys", cron.RefreshURLKeysHandler)
+	cronGroup.GET("/purge-rollbacks", cron.PurgeRollbacksHandler)
+	cronGroup.GET("/backfill-latest", cron.BackfillLatestHandler)
+	cronGroup.GET("/backfill-key-metadata", cron.BackfillKeyMetadataHandler)
+	cronGroup.GET("/migrate-emails", cron.MigrateEmailsHandler)
 }
 
 func createMux() *echo.Echo {
@@ -5,6 +5,7 @@ import (
 
 	"github.com/labstack/echo"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 
 	"auth/scopes"
 	"auth/sessions"
@@ -30,6 +31,7 @@ Obtaining READ scope requires:
 var AuthReadMiddlewares = []echo.MiddlewareFunc{
 	sessions.SessionsMiddleware,
 	sessions.SessionProcessingMiddleware,
+	SessionValidMiddleware,
 	basicAuthMiddlewareRead,
 	readAuthCheckMiddleware,
 }
@@ -38,6 +40,7 @@ var AuthReadMiddlewares = []echo.MiddlewareFunc{
 var AuthWriteMiddlewares = []echo.MiddlewareFunc{
 	sessions.SessionsMiddleware,
 	sessions.SessionProcessingMiddleware,
+	SessionValidMiddleware,
 	basicAuthMiddlewareWrite,
 	writeAuthCheckMiddleware,
 }
@@ -45,6 +48,7 @@ var AuthWriteMiddlewares = []echo.MiddlewareFunc{
 var AuthWriteFallBackToReadMiddlewares = []echo.MiddlewareFunc{
 	sessions.SessionsMiddleware,
 	sessions.SessionProcessingMiddleware,
+	SessionValidMiddleware,
 	basicAuthMiddlewareWrite,
 	basicAuthMiddlewareRead,
 	readAuthCheckMiddleware,
@@ -75,6 +79,44 @@ func AddUserKeyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// SessionValidMiddleware logs out sessions that authenticated before the users password or email last changed.
+// The request can still authenticate with the auth middlewares after it.
+func SessionValidMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userKey, ok := sessions.GetUserKeyFromContext(c)
+		if !ok {
+			return next(c)
+		}
+
+		// users whose email changed have moved to a new user key
+		user, err := users.GetUserByKey(c, userKey)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return echo.NewHTTPError(http.StatusUnauthorized, "Unable to authenticate")
+		}
+
+		authTime, _ := sessions.GetAuthTimeFromContext(c)
+		if err == datastore.ErrNoSuchEntity || authTime.Before(user.SessionsValidAfter) {
+			err = sessions.ResetSession(c)
+			if err != nil {
+				return err
+			}
+		}
+
+		return next(c)
+	}
+}
+
+// CronMiddleware only lets through requests made by the app engine cron service.
+// App Engine strips the X-Appengine-Cron header from external requests.
+func CronMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if c.Request().Header.Get("X-Appengine-Cron") != "true" {
+			return echo.ErrForbidden
+		}
+		return next(c)
+	}
+}
+
 // basic auth middleware for write
 func basicAuthMiddlewareWrite(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -174,6 +216,11 @@ func writeAuthCheckMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 			return echo.NewHTTPError(http.StatusUnauthorized, "Account is not verified")
 		}
 
+		// the users data is being copied to their new email
+		if user.Migrating() {
+			return echo.NewHTTPError(http.StatusConflict, "Account email is being changed")
+		}
+
 		if !hasScope(c, scopes.Write) {
 			c.Response().Header().Set(echo.HeaderWWWAuthenticate, "basic")
 			return echo.NewHTTPError(http.StatusUnauthorized, "Unable to authenticate")
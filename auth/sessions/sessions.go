@@ -3,6 +3,7 @@ package sessions
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/dsoprea/goappenginesessioncascade"
 	"github.com/gorilla/sessions"
@@ -21,6 +22,7 @@ const (
 	defaultMaxAgeSeconds = 10 * 60
 	userKeySessionField  = "userKey"
 	scopeSessionField    = "scope"
+	authTimeSessionField = "authTime"
 )
 
 var (
@@ -58,9 +60,25 @@ func ExpireSession(c echo.Context) error {
 	sess.Options.MaxAge = -1
 	sess.Values[userKeySessionField] = ""
 	sess.Values[scopeSessionField] = ""
+	delete(sess.Values, authTimeSessionField)
 	return sess.Save(c.Request(), c.Response())
 }
 
+// ResetSession erases a user's userkey and scope but keeps their session,
+// so they can authenticate again in the same request
+func ResetSession(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	sess := c.Get(sessionName).(*sessions.Session)
+	delete(sess.Values, userKeySessionField)
+	delete(sess.Values, scopeSessionField)
+	delete(sess.Values, authTimeSessionField)
+	err := sess.Save(c.Request(), c.Response())
+	if err != nil {
+		log.Errorf(ctx, "Unable to save the sess: %+v", err)
+	}
+	return err
+}
+
 // SessionProcessingMiddleware adds sensible defaults to the provided sessions
 func SessionProcessingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -86,12 +104,13 @@ func SessionProcessingMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-// UpdateSession saves a session with the userKey and scope
+// UpdateSession saves a session with the userKey and scope, and the time the user authenticated
 func UpdateSession(c echo.Context, userKey *datastore.Key, scope scopes.Scope) error {
 	ctx := appengine.NewContext(c.Request())
 	sess := c.Get(sessionName).(*sessions.Session)
 	sess.Values[userKeySessionField] = userKey.Encode()
 	sess.Values[scopeSessionField] = scope
+	sess.Values[authTimeSessionField] = time.Now().UnixNano()
 	err := sess.Save(c.Request(), c.Response())
 	if err != nil {
 		log.Errorf(ctx, "Unable to save the sess: %+v", err)
@@ -106,6 +125,16 @@ func GetScopeFromContext(c echo.Context) (scopes.Scope, bool) {
 	return scope, ok
 }
 
+// GetAuthTimeFromContext retrieves when the user of an authd context authenticated
+func GetAuthTimeFromContext(c echo.Context) (time.Time, bool) {
+	sess := c.Get(sessionName).(*sessions.Session)
+	authTime, ok := sess.Values[authTimeSessionField].(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(0, authTime), true
+}
+
 // GetUserKeyFromContext retrieves the user key from an authd context
 func GetUserKeyFromContext(c echo.Context) (*datastore.Key, bool) {
 	ctx := appengine.NewContext(c.Request())
@@ -18,6 +18,7 @@ import (
 	"auth/scopes"
 	"auth/sessions"
 	"config"
+	"events"
 	"users"
 )
 
@@ -129,6 +130,8 @@ func RegisterResponseHandler(c echo.Context) error {
 		return err
 	}
 
+	events.Publish(ctx, userKey, events.Event{Type: events.U2f, Action: events.Created, ID: reg.ID.Encode()})
+
 	return c.JSON(http.StatusOK, reg)
 }
 
@@ -283,6 +286,8 @@ func DeleteRegistrationHandler(c echo.Context) error {
 		return err
 	}
 
+	events.Publish(ctx, userKey, events.Event{Type: events.U2f, Action: events.Deleted, ID: regKey.Encode()})
+
 	return c.String(http.StatusOK, c.Param("id"))
 }
 
@@ -323,6 +328,8 @@ func EnableDisableHandler(c echo.Context) error {
 		return err
 	}
 
+	events.Publish(ctx, userKey, events.Event{Type: events.U2f, Action: events.Updated})
+
 	return c.JSON(http.StatusOK, user)
 }
 
@@ -14,4 +14,28 @@ const (
 	// ApplicationID is the id of this application
 	// ApplicationID = "https://vaelt.xyz"
 	ApplicationID = "https://localhost:3000"
+
+	// HKPKeyserver is the keyserver searched when discovering keys by email
+	HKPKeyserver = "https://keys.openpgp.org"
+
+	// WKDBaseURL sends web key directory lookups to a single server, e.g. a local stand-in.
+	// When empty, lookups go to the domain of the email address.
+	WKDBaseURL = ""
 )
+
+// ProxyAllowedHosts are the scheme and host of keyservers the key proxy will fetch from.
+// Browsers won't load keys from http keyservers on an https page, so they're proxied.
+var ProxyAllowedHosts = []string{
+	"http://keys.openpgp.org",
+	"https://keys.openpgp.org",
+	"http://keyserver.ubuntu.com",
+	"https://keyserver.ubuntu.com",
+	"http://pgp.mit.edu",
+	"https://pgp.mit.edu",
+}
+
+// AttestationRoots are the pem encoded vendor roots that hardware key attestations must chain to.
+// None are shipped, so operators must add the Yubico OpenPGP attestation CA from
+// https://developers.yubico.com/PGP/Attestation.html before keys can be attested.
+// Until a root is set, attestation requests are refused.
+var AttestationRoots = []string{}
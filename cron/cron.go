@@ -0,0 +1,196 @@
+package cron
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"config"
+	"keystore"
+	"mail"
+	"users"
+	"vault"
+)
+
+// keyExpiryWarning is how long before a key expires users start getting reminders
+const keyExpiryWarning = 30 * 24 * time.Hour
+
+// StaleDigestHandler emails users who opted in a digest of their titles that are due for rotation
+func StaleDigestHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKeys, err := vault.DigestUserKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	// keep going on failures so one user doesnt stop everyone elses digest
+	for _, userKey := range userKeys {
+		stale, err := vault.Stale(ctx, userKey)
+		if err != nil || len(stale) == 0 {
+			continue
+		}
+
+		user, err := users.GetUserByKey(c, userKey)
+		if err != nil || !user.Verified {
+			continue
+		}
+
+		// private titles are only known to the client, so they can only be counted
+		var body bytes.Buffer
+		body.WriteString("<div>The following passwords are older than your rotation policy allows:</div><ul>")
+		private := 0
+		for _, title := range stale {
+			if title.Title == "" {
+				private++
+				continue
+			}
+			fmt.Fprintf(&body, "<li>%s (version %d, %d days old)</li>", html.EscapeString(title.Title), title.Version, daysSince(title))
+		}
+		if private > 0 {
+			fmt.Fprintf(&body, "<li>%d private titles</li>", private)
+		}
+		fmt.Fprintf(&body, "</ul><div>Visit <a href=\"%s\">%s</a> to rotate them.</div>", config.ApplicationID, config.ApplicationID)
+
+		err = mail.Send(ctx, user.Email, "Vaelt Passwords Due For Rotation", body.String())
+		if err != nil {
+			log.Errorf(ctx, "Unable to send stale digest: %+v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// KeyExpiryHandler emails users whose keys are about to expire
+func KeyExpiryHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	keys, err := keystore.ExpiringKeys(ctx, keyExpiryWarning)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		threshold, daysLeft := keystore.ExpiryReminderDue(key)
+		if threshold == 0 {
+			continue
+		}
+
+		user, err := users.GetUserByKey(c, key.ID.Parent())
+		if err != nil || !user.Verified {
+			continue
+		}
+
+		body := fmt.Sprintf("<div>Your key %s (%s) expires in %d days, on %s. "+
+			"New passwords cant be encrypted to it after that, so extend its expiry or add another key.</div>"+
+			"<div>Visit <a href=\"%s\">%s</a> to manage your keys.</div>",
+			html.EscapeString(key.Name), key.Fingerprint, daysLeft, key.EncryptionExpiresAt.Format("2006-01-02"),
+			config.ApplicationID, config.ApplicationID)
+		err = mail.Send(ctx, user.Email, "Vaelt Key Expiring Soon", body)
+		if err != nil {
+			log.Errorf(ctx, "Unable to send key expiry reminder: %+v", err)
+			continue
+		}
+
+		// only recorded once sent, so failed reminders are retried on the next run
+		err = keystore.RecordExpiryReminder(ctx, key.ID, threshold)
+		if err != nil {
+			log.Errorf(ctx, "Unable to record key expiry reminder: %+v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// RefreshURLKeysHandler refetches keys with a url and alerts users whose keys changed
+func RefreshURLKeysHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	keyKeys, err := keystore.URLKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, keyKey := range keyKeys {
+		key, newlyFlagged, err := keystore.RefreshURLKey(ctx, keyKey)
+		if err != nil || !newlyFlagged {
+			continue
+		}
+
+		user, err := users.GetUserByKey(c, keyKey.Parent())
+		if err != nil {
+			continue
+		}
+
+		body := fmt.Sprintf("<div>The key %s at %s has changed. It used to have fingerprint %s, but now has fingerprint %s.</div>"+
+			"<div>Nothing new will be encrypted to it until you check the key and add it again. "+
+			"If you didnt change the key, someone may be trying to intercept your passwords.</div>"+
+			"<div>Visit <a href=\"%s\">%s</a> to manage your keys.</div>",
+			html.EscapeString(key.Name), html.EscapeString(key.URL), key.Fingerprint, key.FingerprintMismatch,
+			config.ApplicationID, config.ApplicationID)
+		err = mail.Send(ctx, user.Email, "Vaelt Key Changed", body)
+		if err != nil {
+			log.Errorf(ctx, "Unable to send key changed alert: %+v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// PurgeRollbacksHandler drops the previous wrapping of password keys that can no longer be rolled back to
+func PurgeRollbacksHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	err := keystore.PurgeExpiredRollbacks(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// BackfillKeyMetadataHandler reads the metadata of keys saved before it was kept
+func BackfillKeyMetadataHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	err := keystore.BackfillMetadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// BackfillLatestHandler flags the latest version of titles written before versions were flagged
+func BackfillLatestHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	err := vault.BackfillLatest(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// MigrateEmailsHandler carries on moving users whose email changed to their new user keys
+func MigrateEmailsHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	err := users.ContinueEmailMigrations(ctx)
+	if err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+func daysSince(title vault.StaleTitle) int {
+	return int(time.Since(title.Created).Hours() / 24)
+}
@@ -0,0 +1,170 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+)
+
+const (
+	// Vault events are published when vault entries change
+	Vault = "vault"
+	// Keys events are published when keystore keys change
+	Keys = "keys"
+	// U2f events are published when u2f registrations or settings change
+	U2f = "u2f"
+
+	// Created is the action for new data
+	Created = "created"
+	// Updated is the action for changed data
+	Updated = "updated"
+	// Deleted is the action for removed data
+	Deleted = "deleted"
+
+	subscriberBuffer = 16
+	heartbeatPeriod  = 30 * time.Second
+)
+
+// An Event tells a user's open sessions that some of their data changed
+type Event struct {
+	Type     string `json:"type"`   // either vault, keys or u2f
+	Action   string `json:"action"` // e.g. created, updated or deleted
+	ID       string `json:"id,omitempty"`
+	Revision int64  `json:"revision,omitempty"`
+}
+
+// A Broker fans events out to all of a user's subscribers
+type Broker interface {
+	Publish(ctx context.Context, userID string, event Event) error
+	// Subscribe returns a channel of the user's events and a func to unsubscribe
+	Subscribe(ctx context.Context, userID string) (<-chan Event, func(), error)
+}
+
+// DefaultBroker only reaches subscribers connected to the same instance.
+// Deployments with more than one instance should replace it with a broker
+// backed by a shared message bus.
+var DefaultBroker Broker = newMemoryBroker()
+
+// Publish publishes an event to a user's subscribers.
+// Failures are logged rather than returned, because events are best effort
+// and shouldnt fail the write that caused them.
+func Publish(ctx context.Context, userKey *datastore.Key, event Event) {
+	err := DefaultBroker.Publish(ctx, userKey.Encode(), event)
+	if err != nil {
+		log.Errorf(ctx, "Unable to publish event: %+v", err)
+	}
+}
+
+// StreamHandler streams the user's events as server-sent events
+func StreamHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	events, unsubscribe, err := DefaultBroker.Subscribe(ctx, userKey.Encode())
+	if err != nil {
+		log.Errorf(ctx, "Unable to subscribe to events: %+v", err)
+		return err
+	}
+	defer unsubscribe()
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	heartbeat := time.NewTicker(heartbeatPeriod)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return nil
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+
+			_, err = fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data)
+			if err != nil {
+				return nil
+			}
+		case <-heartbeat.C:
+			// comments keep proxies from timing out idle streams
+			_, err = fmt.Fprint(res, ": heartbeat\n\n")
+			if err != nil {
+				return nil
+			}
+		case <-c.Request().Context().Done():
+			return nil
+		}
+		res.Flush()
+	}
+}
+
+// memoryBroker is a Broker for a single instance
+type memoryBroker struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan Event]bool
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{subscribers: map[string]map[chan Event]bool{}}
+}
+
+func (b *memoryBroker) Publish(ctx context.Context, userID string, event Event) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers[userID] {
+		// drop events for slow subscribers instead of blocking the publisher
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+
+	return nil
+}
+
+func (b *memoryBroker) Subscribe(ctx context.Context, userID string) (<-chan Event, func(), error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, subscriberBuffer)
+	if b.subscribers[userID] == nil {
+		b.subscribers[userID] = map[chan Event]bool{}
+	}
+	b.subscribers[userID][ch] = true
+
+	unsubscribe := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		delete(b.subscribers[userID], ch)
+		if len(b.subscribers[userID]) == 0 {
+			delete(b.subscribers, userID)
+		}
+		close(ch)
+	}
+
+	return ch, unsubscribe, nil
+}
@@ -0,0 +1,165 @@
+package keyserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+
+	"keystore"
+	"users"
+)
+
+const (
+	hkpGet   = "get"
+	hkpIndex = "index"
+)
+
+// LookupHandler is an hkp keyserver for published keys, so gpg --keyserver can find them.
+// The search is an email address, a long key id, or a fingerprint, with a 0x prefix for the latter two.
+// Indexes are always machine readable.
+func LookupHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	op := c.QueryParam("op")
+	if op != hkpGet && op != hkpIndex {
+		return echo.NewHTTPError(http.StatusNotImplemented, fmt.Sprintf("Unsupported operation %s", op))
+	}
+
+	search := strings.TrimSpace(c.QueryParam("search"))
+	var entities []*openpgp.Entity
+	var err error
+	if strings.HasPrefix(strings.ToLower(search), "0x") {
+		entities, err = searchFingerprint(c, search[2:])
+	} else {
+		email := strings.Trim(search, "<>")
+		entities, err = publishedEntities(ctx, keystore.WKDHash(users.LocalPart(email)), users.LocalPart(email), users.Domain(email))
+	}
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		return echo.ErrNotFound
+	}
+
+	if op == hkpIndex {
+		return c.String(http.StatusOK, machineReadableIndex(entities))
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	for _, entity := range entities {
+		err = entity.Serialize(w)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return c.Blob(http.StatusOK, "application/pgp-keys", buf.Bytes())
+}
+
+// searchFingerprint gets the published keys with a fingerprint or long key id
+func searchFingerprint(c echo.Context, fingerprintOrKeyID string) ([]*openpgp.Entity, error) {
+	ctx := appengine.NewContext(c.Request())
+
+	if len(fingerprintOrKeyID) != 16 && len(fingerprintOrKeyID) != 40 && len(fingerprintOrKeyID) != 64 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "Search by long key id or fingerprint")
+	}
+
+	owners, err := keystore.OwnersByFingerprint(ctx, fingerprintOrKeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := []*openpgp.Entity{}
+	for _, owner := range owners {
+		user, err := users.GetUserByKey(c, owner)
+		if err != nil {
+			return nil, err
+		}
+		if !user.PublishKeys || !user.Verified {
+			continue
+		}
+
+		userEntities, err := keystore.PublishedEntities(ctx, owner)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entity := range userEntities {
+			fpr := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+			if strings.EqualFold(fpr, fingerprintOrKeyID) || strings.HasSuffix(fpr, strings.ToUpper(fingerprintOrKeyID)) {
+				entities = append(entities, entity)
+			}
+		}
+	}
+
+	return entities, nil
+}
+
+// machineReadableIndex lists keys in the hkp machine readable index format
+func machineReadableIndex(entities []*openpgp.Entity) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "info:1:%d\n", len(entities))
+	for _, entity := range entities {
+		pk := entity.PrimaryKey
+		bitLength, _ := pk.BitLength()
+
+		expires := ""
+		flags := ""
+		if selfSig, _ := entity.PrimarySelfSignature(); selfSig != nil && selfSig.KeyLifetimeSecs != nil && *selfSig.KeyLifetimeSecs != 0 {
+			expiresAt := pk.CreationTime.Unix() + int64(*selfSig.KeyLifetimeSecs)
+			expires = fmt.Sprint(expiresAt)
+			if pk.KeyExpired(selfSig, time.Now()) {
+				flags = "e"
+			}
+		}
+
+		if entity.Revoked(time.Now()) {
+			flags += "r"
+		}
+
+		fmt.Fprintf(&b, "pub:%X:%d:%d:%d:%s:%s\n", pk.Fingerprint, pk.PubKeyAlgo, bitLength, pk.CreationTime.Unix(), expires, flags)
+
+		names := []string{}
+		for name := range entity.Identities {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			created := ""
+			if sig := entity.Identities[name].SelfSignature; sig != nil {
+				created = fmt.Sprint(sig.CreationTime.Unix())
+			}
+			fmt.Fprintf(&b, "uid:%s:%s::\n", escapeIndexField(name), created)
+		}
+	}
+	return b.String()
+}
+
+// escapeIndexField percent encodes the characters an index line can't contain
+func escapeIndexField(field string) string {
+	var b strings.Builder
+	for _, c := range []byte(field) {
+		if c == ':' || c == '%' || c < 0x20 || c > 0x7e {
+			fmt.Fprintf(&b, "%%%02X", c)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
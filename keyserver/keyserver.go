@@ -0,0 +1,112 @@
+package keyserver
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+
+	"keystore"
+	"users"
+)
+
+// CORSMiddleware lets any site fetch published keys, which web key directory clients expect
+func CORSMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderAccessControlAllowOrigin, "*")
+		return next(c)
+	}
+}
+
+// WKDHandler serves a users published keys with the direct web key directory method,
+// where the domain is the host the request was made to
+func WKDHandler(c echo.Context) error {
+	host := c.Request().Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	return serveWKD(c, strings.ToLower(host))
+}
+
+// AdvancedWKDHandler serves a users published keys with the advanced web key directory method,
+// where the domain is in the path so one server can serve many domains
+func AdvancedWKDHandler(c echo.Context) error {
+	return serveWKD(c, strings.ToLower(c.Param("domain")))
+}
+
+// PolicyHandler serves the web key directory policy file, which says the directory exists
+func PolicyHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "")
+}
+
+// serveWKD serves the keys of the users with a web key directory hash at a domain
+func serveWKD(c echo.Context, domain string) error {
+	ctx := appengine.NewContext(c.Request())
+
+	entities, err := publishedEntities(ctx, c.Param("hash"), c.QueryParam("l"), domain)
+	if err != nil {
+		return err
+	}
+	if len(entities) == 0 {
+		return echo.ErrNotFound
+	}
+
+	// web key directories serve binary keys
+	var buf bytes.Buffer
+	for _, entity := range entities {
+		err = entity.Serialize(&buf)
+		if err != nil {
+			return err
+		}
+	}
+
+	return c.Blob(http.StatusOK, echo.MIMEOctetStream, buf.Bytes())
+}
+
+// publishedEntities gets the published keys of the users with a web key directory hash
+// and an email at domain. Only keys with a user id for the users email are included.
+func publishedEntities(ctx context.Context, hash, localPart, domain string) ([]*openpgp.Entity, error) {
+	userKeys, us, err := users.GetPublishedUsersByWKDHash(ctx, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	entities := []*openpgp.Entity{}
+	for idx, user := range us {
+		if users.Domain(user.Email) != domain {
+			continue
+		}
+		if localPart != "" && !strings.EqualFold(users.LocalPart(user.Email), localPart) {
+			continue
+		}
+
+		userEntities, err := keystore.PublishedEntities(ctx, userKeys[idx])
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entity := range userEntities {
+			if hasEmail(entity, user.Email) {
+				entities = append(entities, entity)
+			}
+		}
+	}
+
+	return entities, nil
+}
+
+// hasEmail reports whether a key has a user id for an email
+func hasEmail(entity *openpgp.Entity, email string) bool {
+	for _, identity := range entity.Identities {
+		if identity.UserId != nil && strings.EqualFold(identity.UserId.Email, email) {
+			return true
+		}
+	}
+	return false
+}
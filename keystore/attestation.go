@@ -0,0 +1,285 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	pgpecdh "github.com/ProtonMail/go-crypto/openpgp/ecdh"
+	pgpecdsa "github.com/ProtonMail/go-crypto/openpgp/ecdsa"
+	pgped25519 "github.com/ProtonMail/go-crypto/openpgp/ed25519"
+	"github.com/ProtonMail/go-crypto/openpgp/eddsa"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/ProtonMail/go-crypto/openpgp/x25519"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"config"
+	"events"
+	"revisions"
+)
+
+const (
+	// keyGenerated is the key source extension value of keys generated on the device, not imported
+	keyGenerated = 0x01
+)
+
+// keySourceExtension is the yubico attestation extension saying where the attested key came from
+var keySourceExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 41482, 5, 2}
+
+// Attestation is an upload of the attestation certificate chain for a hardware key.
+// Chain is pem encoded, starting with the attestation certificate for the key slot.
+type Attestation struct {
+	Chain string `json:"chain"`
+}
+
+// AttestationHandler proves that a yubikey key was generated on the device
+// with the attestation certificate chain for its key slot
+func AttestationHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	keyKey, err := datastore.DecodeKey(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse id key")
+	}
+
+	// make sure the user owns the key
+	if !keyKey.Parent().Equal(userKey) {
+		return echo.ErrNotFound
+	}
+
+	attestation := Attestation{}
+	err = c.Bind(&attestation)
+	if err != nil || attestation.Chain == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "An attestation certificate chain is required")
+	}
+
+	key, err := Attest(ctx, keyKey, attestation.Chain)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, key)
+}
+
+// Attest verifies an attestation certificate chain against the configured roots
+// and the key, and marks the key attested
+func Attest(ctx context.Context, keyKey *datastore.Key, chain string) (Key, error) {
+	if len(config.AttestationRoots) == 0 {
+		log.Errorf(ctx, "Refusing to attest a key since no attestation roots are configured")
+		return Key{}, echo.NewHTTPError(http.StatusNotImplemented, "Key attestation is not set up on this server")
+	}
+
+	certs, err := readCertificates(chain)
+	if err != nil {
+		return Key{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The attestation chain is not valid: %s", err))
+	}
+
+	attestedAt := time.Now()
+	err = verifyAttestation(certs, attestedAt)
+	if err != nil {
+		return Key{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The attestation could not be verified: %s", err))
+	}
+
+	var key Key
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, keyKey, &key)
+		if err == datastore.ErrNoSuchEntity {
+			return echo.ErrNotFound
+		}
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to attest: %+v", err)
+			return err
+		}
+
+		if key.Device != yubikey {
+			return echo.NewHTTPError(http.StatusBadRequest, "Only yubikey keys can be attested")
+		}
+
+		armored := key.ArmoredKey
+		if key.URL != "" {
+			armored = key.CachedArmoredKey
+		}
+
+		entity, err := readEntity(armored)
+		if err != nil {
+			log.Errorf(tc, "Unable to parse key to attest: %+v", err)
+			return err
+		}
+
+		// the attested slot can hold the primary key or any subkey
+		attested := sameKey(entity.PrimaryKey, certs[0].PublicKey)
+		for _, subkey := range entity.Subkeys {
+			attested = attested || sameKey(subkey.PublicKey, certs[0].PublicKey)
+		}
+		if !attested {
+			return echo.NewHTTPError(http.StatusBadRequest, "The attestation is not for this key")
+		}
+
+		key.Attested = true
+		key.AttestedAt = attestedAt
+		key.AttestationChain = chain
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to save attested key: %+v", err)
+			return err
+		}
+
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.ID = keyKey
+	events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+
+	return key, nil
+}
+
+// readCertificates parses a pem encoded certificate chain
+func readCertificates(chain string) ([]*x509.Certificate, error) {
+	certs := []*x509.Certificate{}
+	rest := []byte(chain)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, errors.New("No certificates found")
+	}
+
+	return certs, nil
+}
+
+// verifyAttestation checks that an attestation certificate chains to a configured root
+// and attests a key generated on the device, with every certificate valid at a time.
+// Device attestation certificates aren't marked as CAs, so the chain is checked signature
+// by signature instead of with x509 verification.
+func verifyAttestation(certs []*x509.Certificate, at time.Time) error {
+	for _, cert := range certs {
+		err := checkValidAt(cert, at)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, cert := range certs[:len(certs)-1] {
+		parent := certs[i+1]
+		err := parent.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !signedByRoot(certs[len(certs)-1], at) {
+		return errors.New("The chain does not end at a trusted root")
+	}
+
+	for _, ext := range certs[0].Extensions {
+		if ext.Id.Equal(keySourceExtension) {
+			if len(ext.Value) == 1 && ext.Value[0] == keyGenerated {
+				return nil
+			}
+			return errors.New("The key was imported onto the device")
+		}
+	}
+
+	return errors.New("The attestation does not say where the key came from")
+}
+
+// checkValidAt makes sure a time is within a certificates validity period
+func checkValidAt(cert *x509.Certificate, at time.Time) error {
+	if at.Before(cert.NotBefore) || at.After(cert.NotAfter) {
+		return fmt.Errorf("The certificate for %s is only valid from %s to %s", cert.Subject.CommonName,
+			cert.NotBefore.Format("2006-01-02"), cert.NotAfter.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// signedByRoot reports whether a certificate is, or is signed by, one of the configured roots
+// that is valid at a time
+func signedByRoot(cert *x509.Certificate, at time.Time) bool {
+	for _, root := range config.AttestationRoots {
+		roots, err := readCertificates(root)
+		if err != nil {
+			continue
+		}
+
+		for _, r := range roots {
+			if checkValidAt(r, at) != nil {
+				continue
+			}
+			if r.Equal(cert) {
+				return true
+			}
+			if r.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameKey reports whether an openpgp public key and a certificate's public key are the same key
+func sameKey(pk *packet.PublicKey, certKey interface{}) bool {
+	switch cert := certKey.(type) {
+	case *rsa.PublicKey:
+		pgp, ok := pk.PublicKey.(*rsa.PublicKey)
+		return ok && pgp.N.Cmp(cert.N) == 0 && pgp.E == cert.E
+	case *ecdsa.PublicKey:
+		switch pgp := pk.PublicKey.(type) {
+		case *pgpecdsa.PublicKey:
+			return pgp.X.Cmp(cert.X) == 0 && pgp.Y.Cmp(cert.Y) == 0
+		case *pgpecdh.PublicKey:
+			point, err := cert.ECDH()
+			return err == nil && bytes.Equal(pgp.Point, point.Bytes())
+		}
+	case ed25519.PublicKey:
+		switch pgp := pk.PublicKey.(type) {
+		case *eddsa.PublicKey:
+			return bytes.Equal(pgp.X, cert)
+		case *pgped25519.PublicKey:
+			return bytes.Equal(pgp.Point, cert)
+		}
+	case *ecdh.PublicKey:
+		switch pgp := pk.PublicKey.(type) {
+		case *pgpecdh.PublicKey:
+			return bytes.Equal(pgp.Point, cert.Bytes())
+		case *x25519.PublicKey:
+			return bytes.Equal(pgp.Point, cert.Bytes())
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"events"
+	"revisions"
+)
+
+const (
+	migrationEntityType   = "migration"
+	metadataMigrationName = "keyMetadata"
+)
+
+// A migration records that a backfill has finished
+type migration struct {
+	Finished time.Time
+}
+
+// BackfillMetadata reads the fingerprint and other metadata of keys saved before it was
+// kept, so they can be found by fingerprint for duplicate checks and revocation.
+// Url keys are left to RefreshURLKey. It records when it has finished, so running it
+// again does nothing.
+func BackfillMetadata(ctx context.Context) error {
+	doneKey := datastore.NewKey(ctx, migrationEntityType, metadataMigrationName, 0, nil)
+	err := datastore.Get(ctx, doneKey, &migration{})
+	if err == nil {
+		return nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to get key metadata migration: %+v", err)
+		return err
+	}
+
+	keys := []Key{}
+	keyKeys, err := datastore.NewQuery(keyEntityType).GetAll(ctx, &keys)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get all keys: %+v", err)
+		return err
+	}
+
+	for idx, key := range keys {
+		if key.Fingerprint != "" || key.URL != "" {
+			continue
+		}
+
+		err = backfillKeyMetadata(ctx, keyKeys[idx])
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = datastore.Put(ctx, doneKey, &migration{Finished: time.Now()})
+	if err != nil {
+		log.Errorf(ctx, "Unable to record key metadata migration: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+func backfillKeyMetadata(ctx context.Context, keyKey *datastore.Key) error {
+	changed := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		changed = false
+		var key Key
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to backfill: %+v", err)
+			return err
+		}
+
+		if key.Fingerprint != "" || key.ArmoredKey == "" {
+			return nil
+		}
+
+		// the backfill isnt recorded as finished, so the copy is backfilled on the next run
+		migrating, err := ownerMigrating(tc, keyKey)
+		if err != nil {
+			return err
+		}
+		if migrating {
+			return errors.New("Owner of the key is being moved to a new email")
+		}
+
+		// keys that cant be parsed are left without metadata rather than stopping the backfill
+		entity, err := readEntity(key.ArmoredKey)
+		if err != nil {
+			log.Errorf(tc, "Unable to parse key %s to backfill: %+v", keyKey.Encode(), err)
+			return nil
+		}
+
+		err = key.setMetadata(entity)
+		if err != nil {
+			log.Errorf(tc, "Unable to read metadata of key %s to backfill: %+v", keyKey.Encode(), err)
+			return nil
+		}
+
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to save backfilled key: %+v", err)
+			return err
+		}
+
+		changed = true
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+	}
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package keystore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"config"
+)
+
+const (
+	wkd = "wkd"
+	hkp = "hkp"
+
+	// maxHKPCandidates caps how many keys from a keyserver search are fetched
+	maxHKPCandidates = 10
+
+	zbase32Alphabet = "ybndrfg8ejkmcpqxot1uwisza345h769"
+)
+
+// A Candidate is a key found for an email address. The client picks one, names it,
+// and posts it back as a url key along with its fingerprint, so the same key is added.
+type Candidate struct {
+	Key
+	Source string `json:"source"` // either wkd or hkp
+}
+
+// DiscoverHandler looks up keys for the email query param in the email domain's
+// web key directory and on the configured keyserver
+func DiscoverHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	email := c.QueryParam("email")
+	at := strings.LastIndex(email, "@")
+	if at < 1 || at == len(email)-1 {
+		return echo.NewHTTPError(http.StatusBadRequest, "A valid email is required")
+	}
+
+	// failing lookups just mean fewer candidates
+	candidates := []Candidate{}
+	wkdCandidates, err := discoverWKD(ctx, email[:at], email[at+1:])
+	if err != nil {
+		log.Infof(ctx, "No keys found with wkd: %+v", err)
+	}
+	candidates = append(candidates, wkdCandidates...)
+
+	hkpCandidates, err := discoverHKP(ctx, email)
+	if err != nil {
+		log.Infof(ctx, "No keys found with hkp: %+v", err)
+	}
+	candidates = append(candidates, hkpCandidates...)
+
+	return c.JSON(http.StatusOK, candidates)
+}
+
+// WKDHash gets the web key directory hash of the local part of an email address
+func WKDHash(localPart string) string {
+	sum := sha1.Sum([]byte(strings.ToLower(localPart)))
+	return zbase32(sum[:])
+}
+
+// WKDURLs gets the advanced and direct method web key directory urls for an email address
+func WKDURLs(localPart, domain string) (string, string) {
+	domain = strings.ToLower(domain)
+	advancedBase := "https://openpgpkey." + domain
+	directBase := "https://" + domain
+	if config.WKDBaseURL != "" {
+		advancedBase = config.WKDBaseURL
+		directBase = config.WKDBaseURL
+	}
+
+	path := fmt.Sprintf("hu/%s?l=%s", WKDHash(localPart), url.QueryEscape(localPart))
+	advanced := fmt.Sprintf("%s/.well-known/openpgpkey/%s/%s", advancedBase, domain, path)
+	direct := fmt.Sprintf("%s/.well-known/openpgpkey/%s", directBase, path)
+	return advanced, direct
+}
+
+// discoverWKD looks up keys with the advanced method, falling back to the direct method
+func discoverWKD(ctx context.Context, localPart, domain string) ([]Candidate, error) {
+	advanced, direct := WKDURLs(localPart, domain)
+
+	wkdURL := advanced
+	armored, err := fetchArmoredKey(ctx, wkdURL, nil)
+	if err != nil {
+		wkdURL = direct
+		armored, err = fetchArmoredKey(ctx, wkdURL, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return candidatesFromKeyring(wkd, wkdURL, armored)
+}
+
+// discoverHKP searches the keyserver and fetches each key it finds
+func discoverHKP(ctx context.Context, email string) ([]Candidate, error) {
+	indexURL := fmt.Sprintf("%s/pks/lookup?op=index&options=mr&search=%s", config.HKPKeyserver, url.QueryEscape(email))
+	indexCtx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	err := checkFetchURL(indexURL)
+	if err != nil {
+		return nil, err
+	}
+
+	client := fetchClient(indexCtx, nil)
+	resp, err := client.Get(indexURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Keyserver search returned status %d", resp.StatusCode)
+	}
+
+	candidates := []Candidate{}
+	for _, id := range parseHKPIndex(bufio.NewScanner(io.LimitReader(resp.Body, maxKeySize))) {
+		if len(candidates) == maxHKPCandidates {
+			break
+		}
+
+		keyURL := fmt.Sprintf("%s/pks/lookup?op=get&options=mr&search=0x%s", config.HKPKeyserver, id)
+		armored, err := fetchArmoredKey(ctx, keyURL, nil)
+		if err != nil {
+			log.Infof(ctx, "Unable to fetch key %s from keyserver: %+v", id, err)
+			continue
+		}
+
+		found, err := candidatesFromKeyring(hkp, keyURL, armored)
+		if err != nil {
+			log.Infof(ctx, "Unable to parse key %s from keyserver: %+v", id, err)
+			continue
+		}
+		candidates = append(candidates, found...)
+	}
+
+	return candidates, nil
+}
+
+// parseHKPIndex gets the key ids or fingerprints from a machine readable keyserver index,
+// skipping revoked, disabled and expired keys
+func parseHKPIndex(scanner *bufio.Scanner) []string {
+	ids := []string{}
+	for scanner.Scan() {
+		// pub:<keyid or fingerprint>:<algo>:<keylen>:<created>:<expires>:<flags>
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 2 || fields[0] != "pub" {
+			continue
+		}
+
+		if len(fields) > 6 && strings.ContainsAny(fields[6], "rde") {
+			continue
+		}
+
+		ids = append(ids, strings.ToUpper(fields[1]))
+	}
+	return ids
+}
+
+// candidatesFromKeyring makes a candidate of every key in an armored keyring
+func candidatesFromKeyring(source, keyURL, armored string) ([]Candidate, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+	if len(entities) == 0 {
+		return nil, errors.New("No keys found")
+	}
+
+	candidates := []Candidate{}
+	for _, entity := range entities {
+		if entity.PrivateKey != nil {
+			continue
+		}
+
+		candidate := Candidate{
+			Key: Key{
+				URL:  keyURL,
+				Type: public,
+			},
+			Source: source,
+		}
+		if err := candidate.setMetadata(entity); err != nil {
+			continue
+		}
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates, nil
+}
+
+// zbase32 encodes bytes as z-base-32, which web key directories use for hashes
+func zbase32(data []byte) string {
+	var out strings.Builder
+	var buffer, bits uint
+	for _, b := range data {
+		buffer = buffer<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out.WriteByte(zbase32Alphabet[(buffer>>bits)&31])
+		}
+	}
+	if bits > 0 {
+		out.WriteByte(zbase32Alphabet[(buffer<<(5-bits))&31])
+	}
+	return out.String()
+}
@@ -0,0 +1,30 @@
+package keystore
+
+import "testing"
+
+func TestWKDHash(t *testing.T) {
+	// the example from the web key directory draft, for Joe.Doe@Example.ORG
+	hash := WKDHash("Joe.Doe")
+	if hash != "iy9q119eutrkn8s1mk4r39qejnbu3n5q" {
+		t.Errorf("expected iy9q119eutrkn8s1mk4r39qejnbu3n5q, got %s", hash)
+	}
+}
+
+func TestZbase32(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected string
+	}{
+		{[]byte{}, ""},
+		{[]byte{0}, "yy"},
+		{[]byte{0xff}, "9h"},
+		{[]byte{0xf0, 0xbf, 0xc7}, "6n9hq"},
+	}
+
+	for _, test := range tests {
+		encoded := zbase32(test.data)
+		if encoded != test.expected {
+			t.Errorf("zbase32(%x): expected %s, got %s", test.data, test.expected, encoded)
+		}
+	}
+}
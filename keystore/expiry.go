@@ -0,0 +1,204 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"vault"
+)
+
+const (
+	defaultExpiringDays = 30
+	day                 = 24 * time.Hour
+)
+
+// expiryReminderDays are how many days before a key expires its owner is reminded, largest first
+var expiryReminderDays = []int{30, 7, 1}
+
+func init() {
+	vault.RegisterKeyCheck(checkEncryptable)
+}
+
+// ExpiringHandler gets the users keys that expire within the days query param, 30 by default.
+// Keys that have already expired are included.
+func ExpiringHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	days := defaultExpiringDays
+	if c.QueryParam("days") != "" {
+		var err error
+		days, err = strconv.Atoi(c.QueryParam("days"))
+		if err != nil || days < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "days must be a non-negative number")
+		}
+	}
+
+	keys, err := getAll(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(time.Duration(days) * day)
+	expiring := []Key{}
+	for _, key := range keys {
+		if !key.EncryptionExpiresAt.IsZero() && key.EncryptionExpiresAt.Before(cutoff) {
+			expiring = append(expiring, key)
+		}
+	}
+
+	return c.JSON(http.StatusOK, expiring)
+}
+
+// ExpiringKeys gets the keys of all users that expire within a duration and havent expired yet
+func ExpiringKeys(ctx context.Context, within time.Duration) ([]Key, error) {
+	now := time.Now()
+	keys := []Key{}
+	query := datastore.NewQuery(keyEntityType).
+		Filter("EncryptionExpiresAt >", now).
+		Filter("EncryptionExpiresAt <", now.Add(within))
+	ks, err := query.GetAll(ctx, &keys)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query expiring keys: %+v", err)
+		return nil, err
+	}
+
+	for idx := range keys {
+		keys[idx].ID = ks[idx]
+	}
+
+	return keys, nil
+}
+
+// ExpiryReminderDue gets which of expiryReminderDays the owner of a key is due a reminder for,
+// or 0 if no reminder is due. It also returns the number of days left.
+// A reminder is due each time the key passes one of expiryReminderDays.
+func ExpiryReminderDue(key Key) (int, int) {
+	// nobody needs reminding to replace a revoked key
+	if key.EncryptionExpiresAt.IsZero() || key.Revoked {
+		return 0, 0
+	}
+
+	daysLeft := int(time.Until(key.EncryptionExpiresAt) / day)
+	threshold := 0
+	for _, days := range expiryReminderDays {
+		if daysLeft < days {
+			threshold = days
+		}
+	}
+
+	if threshold == 0 || (key.ExpiryReminderDays != 0 && key.ExpiryReminderDays <= threshold) {
+		return 0, daysLeft
+	}
+
+	return threshold, daysLeft
+}
+
+// RecordExpiryReminder records that the owner of a key was reminded it expires, once the reminder
+// for threshold was sent, so the same reminder isnt sent again
+func RecordExpiryReminder(ctx context.Context, keyKey *datastore.Key, threshold int) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var key Key
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to record reminder: %+v", err)
+			return err
+		}
+
+		if key.ExpiryReminderDays != 0 && key.ExpiryReminderDays <= threshold {
+			return nil
+		}
+
+		migrating, err := ownerMigrating(tc, keyKey)
+		if err != nil || migrating {
+			return err
+		}
+
+		key.ExpiryReminderDays = threshold
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to record expiry reminder: %+v", err)
+			return err
+		}
+
+		return nil
+	}, nil)
+}
+
+// usableForEncryption returns an error if new entries shouldnt be encrypted to the key
+func (k Key) usableForEncryption(now time.Time) error {
+	if k.Revoked {
+		return fmt.Errorf("Key %s was revoked", k.Name)
+	}
+	if k.FingerprintMismatch != "" {
+		return fmt.Errorf("Key %s at %s changed from %s to %s", k.Name, k.URL, k.Fingerprint, k.FingerprintMismatch)
+	}
+	if !k.EncryptionExpiresAt.IsZero() && !now.Before(k.EncryptionExpiresAt) {
+		return fmt.Errorf("Key %s expired on %s", k.Name, k.EncryptionExpiresAt.Format("2006-01-02"))
+	}
+	return nil
+}
+
+// checkEncryptable makes sure new vault entries can be encrypted to all of the keys, and that
+// each entry is encrypted to one of the encryption subkeys of its key, e.g. the subkeys pinned
+// when a url key was fetched rather than whatever the url serves now
+func checkEncryptable(ctx context.Context, entries []vault.Entry) error {
+	keyKeys := []*datastore.Key{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		if !seen[entry.Key.Encode()] {
+			seen[entry.Key.Encode()] = true
+			keyKeys = append(keyKeys, entry.Key)
+		}
+	}
+
+	keys := make([]Key, len(keyKeys))
+	err := datastore.GetMulti(ctx, keyKeys, keys)
+	if err != nil {
+		log.Errorf(ctx, "Failed to get keys to check for encryption: %+v", err)
+		return err
+	}
+
+	now := time.Now()
+	subkeyIDs := map[string]map[string]bool{}
+	for idx, key := range keys {
+		if err := key.usableForEncryption(now); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		subkeyIDs[keyKeys[idx].Encode()] = key.subkeyIDs()
+	}
+
+	for _, entry := range entries {
+		ids := subkeyIDs[entry.Key.Encode()]
+		// keys saved before their metadata was kept have no subkeys to check against
+		if len(ids) == 0 {
+			continue
+		}
+
+		recipients, err := recipientKeyIDs(entry.EncryptedMessage)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unable to read encrypted message: %s", err))
+		}
+		for _, recipient := range recipients {
+			if !ids[recipient] {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Entry is encrypted to %s, which is not a subkey of its key", recipient))
+			}
+		}
+	}
+
+	return nil
+}
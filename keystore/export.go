@@ -0,0 +1,174 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"revisions"
+)
+
+// skippedKeysHeader lists the ids of keys that couldn't be exported
+const skippedKeysHeader = "X-Skipped-Keys"
+
+// ExportHandler gets all of a users public keys as a single armored keyring,
+// which can be imported with gpg --import. Keys that should have been exported
+// but couldn't be, e.g. url keys that haven't been fetched yet, are listed by id
+// in the X-Skipped-Keys header.
+func ExportHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	notModified, err := revisions.CheckETag(c, userKey)
+	if err != nil {
+		return err
+	}
+	if notModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	armored, skipped, err := Export(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	if len(skipped) > 0 {
+		ids := []string{}
+		for _, keyKey := range skipped {
+			ids = append(ids, keyKey.Encode())
+		}
+		c.Response().Header().Set(skippedKeysHeader, strings.Join(ids, ","))
+	}
+
+	c.Response().Header().Set(echo.HeaderContentDisposition, `attachment; filename="keys.asc"`)
+	return c.Blob(http.StatusOK, pgpKeysContentType, []byte(armored))
+}
+
+// Export armors all of a users public keys that can be encrypted to, and gets the ids
+// of the ones that couldn't be exported
+func Export(ctx context.Context, userKey *datastore.Key) (string, []*datastore.Key, error) {
+	entities, skipped, err := publicEntities(ctx, userKey, false)
+	if err != nil {
+		return "", nil, err
+	}
+
+	armored, err := armorPublicKey(entities...)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return armored, skipped, nil
+}
+
+// PublicEntities gets all of a users public keys that can be encrypted to,
+// skipping revoked keys and url keys that changed. Url keys use their cached copy.
+func PublicEntities(ctx context.Context, userKey *datastore.Key) ([]*openpgp.Entity, error) {
+	entities, _, err := publicEntities(ctx, userKey, false)
+	return entities, err
+}
+
+// PublishedEntities gets all of a users public keys to publish, e.g. on a key server.
+// Unlike PublicEntities, revoked keys are included with their revocation signature
+// attached, so anyone who already has them learns they were revoked.
+func PublishedEntities(ctx context.Context, userKey *datastore.Key) ([]*openpgp.Entity, error) {
+	entities, _, err := publicEntities(ctx, userKey, true)
+	return entities, err
+}
+
+// publicEntities gets the entities of a users public keys, and the ids of the keys that
+// couldn't be read. Keys are deduplicated by the fingerprint of the parsed key, since keys
+// saved before fingerprints were kept dont have one.
+func publicEntities(ctx context.Context, userKey *datastore.Key, withRevoked bool) ([]*openpgp.Entity, []*datastore.Key, error) {
+	keys, err := getAll(ctx, userKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	entities := []*openpgp.Entity{}
+	skipped := []*datastore.Key{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		if key.Type != public || (key.Revoked && !withRevoked) || key.FingerprintMismatch != "" {
+			continue
+		}
+
+		armored := key.ArmoredKey
+		if key.URL != "" {
+			armored = key.CachedArmoredKey
+		}
+		if armored == "" {
+			skipped = append(skipped, key.ID)
+			continue
+		}
+
+		entity, err := readEntity(armored)
+		if err != nil {
+			log.Errorf(ctx, "Unable to parse key %s to export: %+v", key.ID.Encode(), err)
+			skipped = append(skipped, key.ID)
+			continue
+		}
+
+		fpr := fingerprint(entity.PrimaryKey)
+		if seen[fpr] {
+			continue
+		}
+
+		// the stored key may not include its revocation
+		if key.Revoked && len(entity.Revocations) == 0 {
+			sig, err := readRevocation(key.RevocationCertificate)
+			if err != nil {
+				log.Errorf(ctx, "Unable to parse revocation of key %s to export: %+v", fpr, err)
+				skipped = append(skipped, key.ID)
+				continue
+			}
+			entity.Revocations = append(entity.Revocations, sig)
+		}
+
+		seen[fpr] = true
+		entities = append(entities, entity)
+	}
+
+	return entities, skipped, nil
+}
+
+// OwnersByFingerprint gets the users with a public key whose fingerprint or key id matches.
+// Key ids are the 16 hex digit long form.
+func OwnersByFingerprint(ctx context.Context, fingerprintOrKeyID string) ([]*datastore.Key, error) {
+	property := "Fingerprint ="
+	if len(fingerprintOrKeyID) == 16 {
+		property = "KeyID ="
+	}
+
+	var keys []Key
+	query := datastore.NewQuery(keyEntityType).
+		Filter(property, strings.ToUpper(fingerprintOrKeyID))
+	ks, err := query.GetAll(ctx, &keys)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query keys by fingerprint: %+v", err)
+		return nil, err
+	}
+
+	owners := []*datastore.Key{}
+	seen := map[string]bool{}
+	for idx, key := range keys {
+		owner := ks[idx].Parent()
+		if key.Type != public || seen[owner.Encode()] {
+			continue
+		}
+		seen[owner.Encode()] = true
+		owners = append(owners, owner)
+	}
+
+	return owners, nil
+}
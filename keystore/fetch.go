@@ -0,0 +1,358 @@
+package keystore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/socket"
+
+	"config"
+	"events"
+	"revisions"
+)
+
+const (
+	// maxKeySize caps how much of a response is read when fetching a key
+	maxKeySize = 1 << 20
+
+	// fetchTimeout caps how long fetching a key can take
+	fetchTimeout = 10 * time.Second
+
+	// maxRedirects caps how many redirects are followed when fetching a key
+	maxRedirects = 5
+)
+
+// fetchArmoredKey fetches a keyring from a url, e.g. a keyserver, and returns it armored.
+// Keyservers often wrap the armored keyring in html, which is fine because
+// armor decoding skips anything before the armor header. Web key directories
+// serve binary keyrings, which are armored here. If allowed is set, only redirects
+// to urls it allows are followed.
+func fetchArmoredKey(ctx context.Context, keyURL string, allowed func(*url.URL) bool) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, fetchTimeout)
+	defer cancel()
+
+	err := checkFetchURL(keyURL)
+	if err != nil {
+		log.Infof(ctx, "Refusing to fetch key: %+v", err)
+		return "", err
+	}
+
+	client := fetchClient(ctx, allowed)
+	resp, err := client.Get(keyURL)
+	if err != nil {
+		log.Errorf(ctx, "Unable to fetch key: %+v", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Fetching key returned status %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxKeySize+1))
+	if err != nil {
+		log.Errorf(ctx, "Unable to read fetched key: %+v", err)
+		return "", err
+	}
+	if len(body) > maxKeySize {
+		return "", errors.New("Fetched key is too large")
+	}
+
+	if bytes.Contains(body, []byte("-----BEGIN PGP")) {
+		return string(body), nil
+	}
+
+	entities, err := openpgp.ReadKeyRing(bytes.NewReader(body))
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse fetched binary key: %+v", err)
+		return "", err
+	}
+
+	return armorPublicKey(entities...)
+}
+
+// fetchClient gets a client that checks every url it fetches, including redirects,
+// and only connects to public addresses, so neither a redirect nor a host that resolves
+// somewhere else the second time can be used to reach an address that was refused.
+// If allowed is set, redirects must also go to urls it allows.
+func fetchClient(ctx context.Context, allowed func(*url.URL) bool) *http.Client {
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext:         publicDialer(ctx),
+			TLSHandshakeTimeout: fetchTimeout,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("Too many redirects")
+			}
+			if allowed != nil && !allowed(req.URL) {
+				return fmt.Errorf("Refusing to follow a redirect to %s", req.URL.Host)
+			}
+			return checkFetchURL(req.URL.String())
+		},
+		Timeout: fetchTimeout,
+	}
+}
+
+// checkFetchURL makes sure a url is http(s) and has a host. Where the host points is
+// checked when connecting to it.
+func checkFetchURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("Only http and https urls can be fetched")
+	}
+
+	if u.Hostname() == "" {
+		return errors.New("A url host is required")
+	}
+
+	return nil
+}
+
+// publicDialer gets a dial func that resolves a host once, refuses it if any of its
+// addresses are private or loopback, and dials the checked address directly.
+// The configured keyserver and web key directory can be anywhere, e.g. a local stand-in.
+func publicDialer(ctx context.Context) func(context.Context, string, string) (net.Conn, error) {
+	return func(_ context.Context, network, addr string) (net.Conn, error) {
+		if configuredAddrs()[strings.ToLower(addr)] {
+			return socket.Dial(ctx, network, addr)
+		}
+
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		ips, err := socket.LookupIP(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, fmt.Errorf("No addresses found for %s", host)
+		}
+
+		for _, ip := range ips {
+			if !publicIP(ip) {
+				return nil, fmt.Errorf("Refusing to fetch from %s", ip)
+			}
+		}
+
+		conn, err := socket.Dial(ctx, network, net.JoinHostPort(ips[0].String(), port))
+		if err != nil {
+			return nil, err
+		}
+
+		// make sure the connection went where it was checked
+		remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+		if !ok || !publicIP(remote.IP) {
+			conn.Close()
+			return nil, fmt.Errorf("Refusing to fetch from %s", conn.RemoteAddr())
+		}
+
+		return conn, nil
+	}
+}
+
+// publicIP reports whether an ip is routable on the public internet
+func publicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, block := range privateBlocks {
+		if block.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// privateBlocks are the address blocks that aren't reachable on the public internet
+var privateBlocks = func() []*net.IPNet {
+	blocks := []*net.IPNet{}
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"fc00::/7",
+	} {
+		_, block, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}()
+
+// origin gets the scheme and host of a url, e.g. https://keys.openpgp.org
+func origin(u *url.URL) string {
+	return strings.ToLower(u.Scheme + "://" + u.Host)
+}
+
+// configuredOrigin gets the origin of a configured url, or nothing if it isn't set
+func configuredOrigin(rawURL string) string {
+	if rawURL == "" {
+		return ""
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	return origin(u)
+}
+
+// configuredAddrs gets the host and port of the configured keyserver and web key directory
+func configuredAddrs() map[string]bool {
+	addrs := map[string]bool{}
+	for _, rawURL := range []string{config.HKPKeyserver, config.WKDBaseURL} {
+		u, err := url.Parse(rawURL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+
+		port := u.Port()
+		if port == "" {
+			port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+		}
+		addrs[strings.ToLower(net.JoinHostPort(u.Hostname(), port))] = true
+	}
+	return addrs
+}
+
+// URLKeys gets the ids of all users keys that have a url
+func URLKeys(ctx context.Context) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(keyEntityType).
+		Filter("URL >", "").
+		KeysOnly()
+	keys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query url keys: %+v", err)
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RefreshURLKey refetches a key with a url and updates its cached copy and metadata,
+// if either changed. FetchedAt is when they last changed. The fingerprint is pinned the first time the key is fetched. If the url later serves
+// a different key, the cache is left alone and the key is flagged so that nothing new
+// is encrypted to it. It reports whether the key was newly flagged.
+func RefreshURLKey(ctx context.Context, keyKey *datastore.Key) (Key, bool, error) {
+	var key Key
+	err := datastore.Get(ctx, keyKey, &key)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get key to refresh: %+v", err)
+		return Key{}, false, err
+	}
+
+	armored, err := fetchArmoredKey(ctx, key.URL, nil)
+	if err != nil {
+		return Key{}, false, err
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil || len(entities) == 0 {
+		log.Errorf(ctx, "Unable to parse refreshed key: %+v", err)
+		return Key{}, false, errors.New("Unable to parse refreshed key")
+	}
+
+	// look for the pinned key, since a url can serve several keys
+	entity := entities[0]
+	for _, e := range entities {
+		if fingerprint(e.PrimaryKey) == key.Fingerprint {
+			entity = e
+		}
+	}
+
+	cached, err := armorPublicKey(entity)
+	if err != nil {
+		return Key{}, false, err
+	}
+
+	newlyFlagged := false
+	changed := false
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		newlyFlagged = false
+		changed = false
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to refresh: %+v", err)
+			return err
+		}
+
+		// the next refresh picks up the keys copy under the new email
+		migrating, err := ownerMigrating(tc, keyKey)
+		if err != nil || migrating {
+			return err
+		}
+
+		fetched := fingerprint(entity.PrimaryKey)
+		if key.Fingerprint != "" && key.Fingerprint != fetched {
+			newlyFlagged = key.FingerprintMismatch != fetched
+			changed = newlyFlagged
+			key.FingerprintMismatch = fetched
+		} else {
+			// keep the reminder state unless the expiry moved
+			before := key
+			err = key.setMetadata(entity)
+			if err != nil {
+				return err
+			}
+			if key.EncryptionExpiresAt.Equal(before.EncryptionExpiresAt) {
+				key.ExpiryReminderDays = before.ExpiryReminderDays
+			}
+
+			changed = !key.sameMetadata(before) || key.CachedArmoredKey != cached || key.FingerprintMismatch != ""
+			key.CachedArmoredKey = cached
+			key.FetchedAt = time.Now()
+			key.FingerprintMismatch = ""
+		}
+
+		// most refreshes find the same key, which shouldnt invalidate clients caches
+		if !changed {
+			return nil
+		}
+
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to save refreshed key: %+v", err)
+			return err
+		}
+
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return Key{}, false, err
+	}
+
+	key.ID = keyKey
+	if changed {
+		events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+	}
+
+	return key, newlyFlagged, nil
+}
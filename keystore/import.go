@@ -0,0 +1,201 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+
+	"auth/sessions"
+)
+
+// KeyringImport is an armored keyring of public keys to add, e.g. from gpg --export --armor.
+// Each key gets its own record named after its first user id, on Device (unknown by default).
+// Subkeys picks the encryption subkeys to keep by fingerprint or key id, every usable one by default.
+type KeyringImport struct {
+	ArmoredKeyring string   `json:"armoredKeyring"`
+	Device         string   `json:"device"`
+	Subkeys        []string `json:"subkeys"`
+}
+
+// ImportResult reports what happened to each key, and each of its encryption subkeys,
+// in an imported keyring. Added keys list the subkeys that were kept.
+type ImportResult struct {
+	Added    []Key         `json:"added"`
+	Skipped  []ImportIssue `json:"skipped"`  // already in the keystore or not selected
+	Rejected []ImportIssue `json:"rejected"` // not usable for encryption
+}
+
+// ImportIssue is a key, or one of its encryption subkeys, from an imported keyring that wasn't added
+type ImportIssue struct {
+	Fingerprint string   `json:"fingerprint"`
+	Subkey      string   `json:"subkey,omitempty"` // the fingerprint of the subkey, if the issue is only with it
+	UserIDs     []string `json:"userIds"`
+	Reason      string   `json:"reason"`
+}
+
+// ImportHandler adds every public key in an armored keyring
+func ImportHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	keyring := KeyringImport{}
+	err := c.Bind(&keyring)
+	if err != nil || keyring.ArmoredKeyring == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "An armoredKeyring is required")
+	}
+
+	if keyring.Device == "" {
+		keyring.Device = unknown
+	} else if !devices[keyring.Device] {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown device %s", keyring.Device))
+	}
+
+	result, err := Import(ctx, keyring, userKey)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, result)
+}
+
+// Import splits a keyring into one key per entity, keeping only its selected and usable
+// encryption subkeys, and puts the ones that are new
+func Import(ctx context.Context, keyring KeyringImport, userKey *datastore.Key) (ImportResult, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(keyring.ArmoredKeyring))
+	if err != nil {
+		return ImportResult{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The provided keyring is not valid: %s", err))
+	}
+
+	selected := map[string]bool{}
+	for _, id := range keyring.Subkeys {
+		selected[strings.ToUpper(strings.Replace(id, " ", "", -1))] = true
+	}
+
+	result := ImportResult{Added: []Key{}, Skipped: []ImportIssue{}, Rejected: []ImportIssue{}}
+	keys := []Key{}
+	seen := map[string]bool{}
+	now := time.Now()
+	for _, entity := range entities {
+		key, subkeyIssues, err := importedKey(entity, keyring.Device, selected, now)
+		result.Skipped = append(result.Skipped, subkeyIssues.Skipped...)
+		result.Rejected = append(result.Rejected, subkeyIssues.Rejected...)
+		if err != nil {
+			result.Rejected = append(result.Rejected, ImportIssue{Fingerprint: key.Fingerprint, UserIDs: key.UserIDs, Reason: err.Error()})
+			continue
+		}
+		if len(key.Subkeys) == 0 {
+			continue
+		}
+
+		existing, err := getByFingerprint(ctx, key.Fingerprint, public, userKey)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		if existing != nil || seen[key.Fingerprint] {
+			for _, sk := range key.Subkeys {
+				result.Skipped = append(result.Skipped, ImportIssue{
+					Fingerprint: key.Fingerprint,
+					Subkey:      sk.Fingerprint,
+					UserIDs:     key.UserIDs,
+					Reason:      "Key is already in the keystore",
+				})
+			}
+			continue
+		}
+
+		seen[key.Fingerprint] = true
+		keys = append(keys, key)
+	}
+
+	if len(keys) > 0 {
+		err = Put(ctx, keys, userKey)
+		if err != nil {
+			return ImportResult{}, err
+		}
+		result.Added = keys
+	}
+
+	return result, nil
+}
+
+// importedKey makes a public key from a keyring entity, keeping only the encryption subkeys
+// that are selected, or all of them if none are, and havent expired. The subkeys that are
+// dropped are reported in the result. A key without subkeys to keep has none.
+func importedKey(entity *openpgp.Entity, device string, selected map[string]bool, now time.Time) (Key, ImportResult, error) {
+	issues := ImportResult{}
+	key := Key{Type: public, Device: device}
+	err := key.setMetadata(entity)
+	if err != nil {
+		return key, issues, err
+	}
+
+	if entity.PrivateKey != nil {
+		return key, issues, errors.New("Private keys must be added one at a time")
+	}
+
+	if entity.Revoked(now) {
+		return key, issues, errors.New("Key is revoked")
+	}
+
+	if len(key.Subkeys) == 0 {
+		return key, issues, errors.New("Key has no encryption subkeys")
+	}
+
+	subkeys := []openpgp.Subkey{}
+	for _, sk := range entity.Subkeys {
+		if !canEncrypt(sk) {
+			continue
+		}
+
+		issue := ImportIssue{Fingerprint: key.Fingerprint, Subkey: fingerprint(sk.PublicKey), UserIDs: key.UserIDs}
+		expiresAt := expiry(sk.PublicKey, sk.Sig)
+		if len(selected) > 0 && !selected[fingerprint(sk.PublicKey)] && !selected[keyID(sk.PublicKey)] {
+			issue.Reason = "Subkey was not selected"
+			issues.Skipped = append(issues.Skipped, issue)
+			continue
+		}
+		if !expiresAt.IsZero() && !now.Before(expiresAt) {
+			issue.Reason = fmt.Sprintf("Subkey expired on %s", expiresAt.Format("2006-01-02"))
+			issues.Rejected = append(issues.Rejected, issue)
+			continue
+		}
+
+		subkeys = append(subkeys, sk)
+	}
+	entity.Subkeys = subkeys
+
+	err = key.setMetadata(entity)
+	if err != nil {
+		return key, issues, err
+	}
+	if len(key.Subkeys) == 0 {
+		return key, issues, nil
+	}
+
+	if err := key.usableForEncryption(now); err != nil {
+		return key, issues, err
+	}
+
+	key.ArmoredKey, err = armorPublicKey(entity)
+	if err != nil {
+		return key, issues, err
+	}
+
+	key.Name = key.KeyID
+	if len(key.UserIDs) > 0 {
+		key.Name = key.UserIDs[0]
+	}
+
+	return key, issues, nil
+}
@@ -2,20 +2,26 @@ package keystore
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp"
 	"github.com/labstack/echo"
-	"golang.org/x/crypto/openpgp/armor"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
+	"google.golang.org/appengine/memcache"
 
 	"auth/sessions"
+	"config"
+	"events"
+	"revisions"
 	"vault"
 )
 
@@ -23,19 +29,98 @@ const (
 	public        = "public"
 	private       = "private"
 	keyEntityType = "key"
+
+	yubikey  = "yubikey"
+	password = "password"
+	unknown  = "unknown"
+
+	pgpKeysContentType   = "application/pgp-keys"
+	proxyCacheExpiration = time.Hour
+
+	// lastUsedResolution is how out of date a keys LastUsedAt can be
+	lastUsedResolution = time.Hour
 )
 
+// devices are the kinds of device a key can live on
+var devices = map[string]bool{
+	yubikey:  true,
+	password: true,
+	unknown:  true,
+}
+
+// userMigrating checks if a user is being moved to a new email, when their keys are being copied
+var userMigrating func(ctx context.Context, userKey *datastore.Key) (bool, error)
+
+// RegisterMigratingCheck sets the check that a user is being moved to a new email. Writes that
+// dont go through the write auth middleware, e.g. from cron, check it in their transaction, so
+// they arent lost when the users keys are copied. The users package registers it because
+// keystore cant import users.
+func RegisterMigratingCheck(check func(ctx context.Context, userKey *datastore.Key) (bool, error)) {
+	userMigrating = check
+}
+
+// ownerMigrating checks if the owner of a key is being moved to a new email
+func ownerMigrating(ctx context.Context, keyKey *datastore.Key) (bool, error) {
+	if userMigrating == nil {
+		return false, nil
+	}
+	return userMigrating(ctx, keyKey.Parent())
+}
+
 // Key represents a public or private key.
 // Exactly one of URL or ArmoredKey should be non-empty.
-// Private keys should all be protected by a passphrase.
+// Private keys must be protected by a strong passphrase s2k and cipher.
+// The remaining fields are parsed from the key when it is saved.
 type Key struct {
 	ID         *datastore.Key `datastore:"-" json:"id"`
 	Name       string         `json:"name"`
 	URL        string         `json:"url"`
 	ArmoredKey string         `datastore:",noindex" json:"armoredKey"`
 	Type       string         `json:"type"`   // either public or private
-	Device     string         `json:"device"` // either yubikey, password, or unknown
+	Device     string         `json:"device"` // one of devices
 	CreatedAt  time.Time      `json:"createdAt"`
+
+	Fingerprint  string    `json:"fingerprint"`
+	KeyID        string    `json:"keyId"`
+	Algorithm    string    `json:"algorithm"`
+	BitLength    int       `json:"bitLength"`
+	KeyCreatedAt time.Time `json:"keyCreatedAt"`
+	ExpiresAt    time.Time `json:"expiresAt"` // zero if the key never expires
+	UserIDs      []string  `json:"userIds"`
+	Subkeys      []Subkey  `json:"subkeys"` // encryption capable subkeys
+
+	// EncryptionExpiresAt is when the key can no longer be encrypted to, zero if never
+	EncryptionExpiresAt time.Time `json:"encryptionExpiresAt"`
+	// ExpiryReminderDays is the smallest reminder threshold the owner was emailed about
+	ExpiryReminderDays int `json:"-"`
+
+	// Keys with a url are fetched by the server, which caches them and pins their fingerprint
+	CachedArmoredKey string    `datastore:",noindex" json:"cachedArmoredKey"`
+	FetchedAt        time.Time `json:"fetchedAt"`
+	// FingerprintMismatch is the fingerprint of a different key found at the url, which blocks encryption
+	FingerprintMismatch string `json:"fingerprintMismatch"`
+
+	// Password private keys keep their previous wrapping for a while after a password change
+	PreviousArmoredKey string    `datastore:",noindex" json:"-"`
+	RollbackExpiresAt  time.Time `json:"rollbackExpiresAt"` // zero if there is nothing to roll back to
+
+	// Revoked keys can't be encrypted to, but their entries are kept until the key is deleted
+	Revoked               bool      `json:"revoked"`
+	RevokedAt             time.Time `json:"revokedAt"`
+	RevocationReason      string    `json:"revocationReason"` // one of revocationReasons
+	RevocationComment     string    `datastore:",noindex" json:"revocationComment"`
+	RevocationCertificate string    `datastore:",noindex" json:"revocationCertificate"`
+
+	// Attested keys are proven to have been generated on their hardware device
+	Attested         bool      `json:"attested"`
+	AttestedAt       time.Time `json:"attestedAt"`
+	AttestationChain string    `datastore:",noindex" json:"attestationChain"`
+
+	// LastUsedAt is roughly when a password private key was last fetched to decrypt, zero if never.
+	// It is updated without bumping the revision, so listings can be behind until the next change.
+	LastUsedAt time.Time `json:"lastUsedAt"`
+	// Usage is filled in on listings
+	Usage *vault.Usage `datastore:"-" json:"usage,omitempty"`
 }
 
 // GetAllHandler gets all of a users keys
@@ -48,8 +133,15 @@ func GetAllHandler(c echo.Context) error {
 		return errors.New("Could not get user key from context")
 	}
 
+	notModified, err := revisions.CheckETag(c, userKey)
+	if err != nil {
+		return err
+	}
+	if notModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	var keys []Key
-	var err error
 
 	keyKeys := []*datastore.Key{}
 	params := c.QueryParams()
@@ -75,6 +167,15 @@ func GetAllHandler(c echo.Context) error {
 		}
 	}
 
+	usages, err := vault.UsageByKey(ctx, userKey)
+	if err != nil {
+		return err
+	}
+	for idx := range keys {
+		usage := usages[keys[idx].ID.Encode()]
+		keys[idx].Usage = &usage
+	}
+
 	return c.JSON(http.StatusOK, keys)
 }
 
@@ -114,9 +215,52 @@ func GetPasswordPrivateKeyHandler(c echo.Context) error {
 		return err
 	}
 
+	passwordKey, err = markUsed(ctx, passwordKey)
+	if err != nil {
+		return err
+	}
+
 	return c.JSON(http.StatusOK, passwordKey)
 }
 
+// markUsed records that a key was just used. Fetching a key shouldnt invalidate cached
+// listings, so the revision isnt bumped, and LastUsedAt is only updated once it is older
+// than lastUsedResolution, so most fetches dont write at all.
+func markUsed(ctx context.Context, key Key) (Key, error) {
+	if time.Since(key.LastUsedAt) < lastUsedResolution {
+		return key, nil
+	}
+
+	keyKey := key.ID
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to mark used: %+v", err)
+			return err
+		}
+
+		migrating, err := ownerMigrating(tc, keyKey)
+		if err != nil || migrating {
+			return err
+		}
+
+		key.LastUsedAt = time.Now()
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to mark key used: %+v", err)
+			return err
+		}
+
+		return nil
+	}, nil)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.ID = keyKey
+	return key, nil
+}
+
 // PostHandler posts a new key
 func PostHandler(c echo.Context) error {
 	ctx := appengine.NewContext(c.Request())
@@ -131,22 +275,6 @@ func PostHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "Could not parse the request body")
 	}
 
-	// fetch all keys to make sure the entry is not a duplicate
-	allKeys, err := getAll(ctx, userKey)
-	if err != nil {
-		return err
-	}
-
-	for _, key := range keys {
-		// make sure the entry is not a duplicate
-		// this is not performant but it shouldnt matter
-		for _, k := range allKeys {
-			if (k.URL != "" && k.URL == key.URL) || (k.ArmoredKey != "" && k.ArmoredKey == key.ArmoredKey) {
-				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Key is identical to existing key (%s)", k.Name))
-			}
-		}
-	}
-
 	err = Put(ctx, keys, userKey)
 	if err != nil {
 		return err
@@ -185,9 +313,184 @@ func RevokeHandler(c echo.Context) error {
 		return err
 	}
 
+	_, err = revisions.Bump(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	events.Publish(ctx, userKey, events.Event{Type: events.Keys, Action: events.Deleted, ID: key.Encode()})
+
 	return c.String(http.StatusOK, c.Param("id"))
 }
 
+// KeyPatch is a change to a key. Only the fields that are set are changed.
+// ArmoredKey can only be replaced on password private keys, with a re-wrapped copy of the same key.
+type KeyPatch struct {
+	Name       *string `json:"name"`
+	Device     *string `json:"device"`
+	ArmoredKey *string `json:"armoredKey"`
+}
+
+// PatchHandler updates the name, device, or wrapping of a key
+func PatchHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	keyKey, err := datastore.DecodeKey(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse id key")
+	}
+
+	// make sure the user owns the key
+	if !keyKey.Parent().Equal(userKey) {
+		return echo.ErrNotFound
+	}
+
+	patch := KeyPatch{}
+	err = c.Bind(&patch)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Could not parse the request body")
+	}
+
+	key, err := Patch(ctx, keyKey, patch)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, key)
+}
+
+// Patch applies a change to a key
+func Patch(ctx context.Context, keyKey *datastore.Key, patch KeyPatch) (Key, error) {
+	if patch.Name != nil && *patch.Name == "" {
+		return Key{}, echo.NewHTTPError(http.StatusBadRequest, "A name is required")
+	}
+
+	if patch.Device != nil && !devices[*patch.Device] {
+		return Key{}, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown device %s", *patch.Device))
+	}
+
+	var key Key
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := datastore.Get(tc, keyKey, &key)
+		if err == datastore.ErrNoSuchEntity {
+			return echo.ErrNotFound
+		}
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to patch: %+v", err)
+			return err
+		}
+
+		if patch.Name != nil {
+			key.Name = *patch.Name
+		}
+		if patch.Device != nil {
+			// an attestation only holds for the device it was made on
+			if *patch.Device != key.Device {
+				key.Attested = false
+				key.AttestedAt = time.Time{}
+				key.AttestationChain = ""
+			}
+			key.Device = *patch.Device
+		}
+
+		if patch.ArmoredKey != nil {
+			err = key.rewrap(*patch.ArmoredKey)
+			if err != nil {
+				return err
+			}
+		}
+
+		// password private keys are looked up by name, so names cant be shared
+		if key.Type == private && key.Device == password {
+			existing, err := getPasswordPrivateKey(tc, key.Name, keyKey.Parent())
+			if err != nil && err != echo.ErrNotFound {
+				return err
+			}
+			if err == nil && !existing.ID.Equal(keyKey) {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("A password key is already named %s", key.Name))
+			}
+		}
+
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to save patched key: %+v", err)
+			return err
+		}
+
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return Key{}, err
+	}
+
+	key.ID = keyKey
+	events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+
+	return key, nil
+}
+
+// rewrap replaces a password private key with a copy of the same key protected by a new passphrase
+func (k *Key) rewrap(armored string) error {
+	if k.Type != private || k.Device != password || k.URL != "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only password private keys can be replaced")
+	}
+
+	entity, err := readEntity(armored)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The provided key is not a valid OpenPGP key: %s", err))
+	}
+
+	if entity.PrivateKey == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "The provided key is not a private key")
+	}
+
+	if fingerprint(entity.PrimaryKey) != k.Fingerprint {
+		return echo.NewHTTPError(http.StatusBadRequest, "The provided key is not the same key")
+	}
+
+	// entries are encrypted to the subkeys, so they can't change either
+	if !sameEncryptionSubkeys(entity, k.Subkeys) {
+		return echo.NewHTTPError(http.StatusBadRequest, "The provided key does not have the same encryption subkeys")
+	}
+
+	err = checkPrivateKeyProtection(armored)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	previous := k.ArmoredKey
+	err = k.replaceArmoredKey(entity, armored)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// keep the old wrapping in case the new password doesn't work out
+	k.PreviousArmoredKey = previous
+	k.RollbackExpiresAt = time.Now().Add(rollbackWindow)
+	return nil
+}
+
+// replaceArmoredKey swaps in another copy of the same key
+func (k *Key) replaceArmoredKey(entity *openpgp.Entity, armored string) error {
+	// keep the reminder state unless the expiry moved
+	expiresAt, reminderDays := k.EncryptionExpiresAt, k.ExpiryReminderDays
+	err := k.setMetadata(entity)
+	if err != nil {
+		return err
+	}
+	if k.EncryptionExpiresAt.Equal(expiresAt) {
+		k.ExpiryReminderDays = reminderDays
+	}
+
+	k.ArmoredKey = armored
+	return nil
+}
+
 // ProxyHandler proxies requests for certs.
 // sks-keyservers can either serve over http, or use
 // tls certs from an untrusted CA so chrome wont load it.
@@ -195,23 +498,75 @@ func RevokeHandler(c echo.Context) error {
 // custom CA certs so we can't even verify sks-keyserver
 // requests against their root CA :(
 // See https://github.com/GoogleCloudPlatform/python-compat-runtime/pull/124
+// Only keyservers in config.ProxyAllowedHosts are proxied, and only public keys are returned.
 func ProxyHandler(c echo.Context) error {
 	ctx := appengine.NewContext(c.Request())
-	client := urlfetch.Client(ctx)
-	resp, err := client.Get(c.QueryParam("url"))
+
+	keyURL := c.QueryParam("url")
+	u, err := url.Parse(keyURL)
+	if err != nil || !proxyAllowed(u) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Keys can only be proxied from an allowed keyserver")
+	}
+
+	cacheKey := proxyCacheKey(keyURL)
+	item, err := memcache.Get(ctx, cacheKey)
+	if err == nil {
+		return c.Blob(http.StatusOK, pgpKeysContentType, item.Value)
+	}
+	if err != memcache.ErrCacheMiss {
+		log.Errorf(ctx, "Unable to get proxied key from cache: %+v", err)
+	}
+
+	fetched, err := fetchArmoredKey(ctx, keyURL, proxyAllowed)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadGateway, "Unable to fetch key")
+	}
+
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(fetched))
+	if err != nil || len(entities) == 0 {
+		return echo.NewHTTPError(http.StatusBadGateway, "Keyserver did not return a public key")
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey != nil {
+			return echo.NewHTTPError(http.StatusBadGateway, "Keyserver did not return a public key")
+		}
+	}
+
+	armored, err := armorPublicKey(entities...)
 	if err != nil {
-		log.Errorf(ctx, "Unable to proxy key req: %+v", err)
 		return err
 	}
-	defer resp.Body.Close()
-	contentType := resp.Header.Get("Content-Type")
-	if contentType == "" {
-		contentType = "text/plain"
+
+	err = memcache.Set(ctx, &memcache.Item{
+		Key:        cacheKey,
+		Value:      []byte(armored),
+		Expiration: proxyCacheExpiration,
+	})
+	if err != nil {
+		log.Errorf(ctx, "Unable to cache proxied key: %+v", err)
 	}
-	return c.Stream(resp.StatusCode, contentType, resp.Body)
+
+	return c.Blob(http.StatusOK, pgpKeysContentType, []byte(armored))
 }
 
-// Put saves keys
+// proxyAllowed reports whether a url is on one of the allowed keyservers
+func proxyAllowed(u *url.URL) bool {
+	for _, allowed := range config.ProxyAllowedHosts {
+		if origin(u) == configuredOrigin(allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// proxyCacheKey gets the memcache key of a proxied url
+func proxyCacheKey(keyURL string) string {
+	sum := sha256.Sum256([]byte(keyURL))
+	return "keyproxy:" + hex.EncodeToString(sum[:])
+}
+
+// Put saves keys. Keys with a url are fetched to read their metadata.
+// A user can only have one public and one private key per fingerprint.
 func Put(ctx context.Context, keys []Key, userKey *datastore.Key) error {
 	keyKeys := []*datastore.Key{}
 	for idx, key := range keys {
@@ -220,31 +575,121 @@ func Put(ctx context.Context, keys []Key, userKey *datastore.Key) error {
 			return echo.NewHTTPError(http.StatusBadRequest, "Only one of armoredKey and url should be provided")
 		}
 
-		// make sure the armored key is valid
-		if key.ArmoredKey != "" {
-			_, err := armor.Decode(strings.NewReader(key.ArmoredKey))
+		if key.Type != public && key.Type != private {
+			return errors.New("Key type must be private or public")
+		}
+
+		if key.Device == "" {
+			keys[idx].Device = unknown
+		} else if !devices[key.Device] {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Unknown device %s", key.Device))
+		}
+
+		// a client can pick a key by fingerprint when a url serves several
+		wantFingerprint := ""
+		if key.URL != "" {
+			wantFingerprint = key.Fingerprint
+		}
+
+		armored := key.ArmoredKey
+		keys[idx].CachedArmoredKey = ""
+		keys[idx].FetchedAt = time.Time{}
+		keys[idx].FingerprintMismatch = ""
+		keys[idx].PreviousArmoredKey = ""
+		keys[idx].RollbackExpiresAt = time.Time{}
+		keys[idx].Revoked = false
+		keys[idx].RevokedAt = time.Time{}
+		keys[idx].RevocationReason = ""
+		keys[idx].RevocationComment = ""
+		keys[idx].RevocationCertificate = ""
+		keys[idx].Attested = false
+		keys[idx].AttestedAt = time.Time{}
+		keys[idx].AttestationChain = ""
+		keys[idx].LastUsedAt = time.Time{}
+		if key.URL != "" {
+			if key.Type != public {
+				return echo.NewHTTPError(http.StatusBadRequest, "Only public keys can be provided by url")
+			}
+
+			var err error
+			armored, err = fetchArmoredKey(ctx, key.URL, nil)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Unable to fetch a key from the provided url")
+			}
+		}
+
+		// make sure the key is a single openpgp key of the right type
+		keys[idx].clearMetadata()
+		entity, err := selectEntity(armored, wantFingerprint)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The provided key is not a valid OpenPGP key: %s", err))
+		}
+
+		if (entity.PrivateKey != nil) != (key.Type == private) {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The provided key is not a %s key", key.Type))
+		}
+
+		if key.Type == private {
+			err = checkPrivateKeyProtection(armored)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "The provided armored key is not valid")
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 			}
 		}
 
-		if key.Type != public && key.Type != private {
-			return errors.New("Key type must be private or public")
+		err = keys[idx].setMetadata(entity)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+
+		// cache a clean copy of url keys, since keyservers wrap them in html
+		if key.URL != "" {
+			keys[idx].CachedArmoredKey, err = armorPublicKey(entity)
+			if err != nil {
+				return err
+			}
+			keys[idx].FetchedAt = time.Now()
+		}
+
+		// make sure the keys being put dont duplicate each other
+		for _, k := range keys[:idx] {
+			if k.Fingerprint == keys[idx].Fingerprint && k.Type == key.Type {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Key is identical to another new key (%s)", k.Name))
+			}
 		}
 
 		keys[idx].CreatedAt = time.Now()
 		keyKeys = append(keyKeys, datastore.NewIncompleteKey(ctx, keyEntityType, userKey))
 	}
 
-	var err error
-	keyKeys, err = datastore.PutMulti(ctx, keyKeys, keys)
+	// check for duplicates in the same transaction as the put so concurrent puts cant both succeed
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		for _, key := range keys {
+			existing, err := getByFingerprint(tc, key.Fingerprint, key.Type, userKey)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Key is identical to existing key (%s)", existing.Name))
+			}
+		}
+
+		var err error
+		keyKeys, err = datastore.PutMulti(tc, keyKeys, keys)
+		if err != nil {
+			log.Errorf(tc, "Error putting to keystore: %+v", err)
+			return err
+		}
+
+		_, err = revisions.Increment(tc, userKey)
+		return err
+	}, nil)
 	if err != nil {
-		log.Errorf(ctx, "Error putting to keystore: %+v", err)
 		return err
 	}
 
 	for idx := range keys {
 		keys[idx].ID = keyKeys[idx]
+		events.Publish(ctx, userKey, events.Event{Type: events.Keys, Action: events.Created, ID: keyKeys[idx].Encode()})
 	}
 
 	return nil
@@ -268,6 +713,28 @@ func getAll(ctx context.Context, userKey *datastore.Key) ([]Key, error) {
 	return keys, nil
 }
 
+// getByFingerprint gets a users key of a type by its primary key fingerprint, or nil if there isnt one
+func getByFingerprint(ctx context.Context, fingerprint, keyType string, userKey *datastore.Key) (*Key, error) {
+	var keys []Key
+	query := datastore.NewQuery(keyEntityType).
+		Filter("Fingerprint =", fingerprint).
+		Filter("Type =", keyType).
+		Ancestor(userKey).
+		Limit(1)
+	ks, err := query.GetAll(ctx, &keys)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query keys by fingerprint: %+v", err)
+		return nil, err
+	}
+
+	if len(ks) == 0 {
+		return nil, nil
+	}
+
+	keys[0].ID = ks[0]
+	return &keys[0], nil
+}
+
 func getByKeys(ctx context.Context, keyKeys []*datastore.Key, userKey *datastore.Key) ([]Key, error) {
 	for _, key := range keyKeys {
 		if !key.Parent().Equal(userKey) {
@@ -292,9 +759,9 @@ func getByKeys(ctx context.Context, keyKeys []*datastore.Key, userKey *datastore
 func getPasswordPrivateKey(ctx context.Context, keyName string, userKey *datastore.Key) (Key, error) {
 	var keys []Key
 	query := datastore.NewQuery(keyEntityType).
-		Filter("Type =", "private").
+		Filter("Type =", private).
 		Filter("Name =", keyName).
-		Filter("Device =", "password").
+		Filter("Device =", password).
 		Ancestor(userKey)
 	ks, err := query.GetAll(ctx, &keys)
 	if err != nil {
@@ -0,0 +1,203 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"events"
+	"revisions"
+)
+
+const (
+	// rollbackWindow is how long the previous wrapping of a password key is kept
+	rollbackWindow = 24 * time.Hour
+)
+
+// PutPasswordPrivateKeyHandler replaces the private key for a users password
+// with a copy of the same key wrapped with a new password
+func PutPasswordPrivateKeyHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	key := Key{}
+	err := c.Bind(&key)
+	if err != nil || key.ArmoredKey == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "An armoredKey is required")
+	}
+
+	passwordKey, err := getPasswordPrivateKey(ctx, c.Param("name"), userKey)
+	if err != nil {
+		return err
+	}
+
+	passwordKey, err = Patch(ctx, passwordKey.ID, KeyPatch{ArmoredKey: &key.ArmoredKey})
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, passwordKey)
+}
+
+// RollbackPasswordPrivateKeyHandler restores the previous wrapping of the private key
+// for a users password, as long as the password was changed recently
+func RollbackPasswordPrivateKeyHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	passwordKey, err := getPasswordPrivateKey(ctx, c.Param("name"), userKey)
+	if err != nil {
+		return err
+	}
+
+	passwordKey, err = rollback(ctx, passwordKey.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, passwordKey)
+}
+
+// rollback swaps a password key back to its previous wrapping
+func rollback(ctx context.Context, keyKey *datastore.Key) (Key, error) {
+	var key Key
+	expired := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		expired = false
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to roll back: %+v", err)
+			return err
+		}
+
+		if key.PreviousArmoredKey == "" {
+			return echo.NewHTTPError(http.StatusBadRequest, "There is no previous key to roll back to")
+		}
+
+		if time.Now().After(key.RollbackExpiresAt) {
+			// too late, so drop the old wrapping
+			expired = true
+			key.PreviousArmoredKey = ""
+			key.RollbackExpiresAt = time.Time{}
+			_, err = datastore.Put(tc, keyKey, &key)
+			if err != nil {
+				log.Errorf(tc, "Unable to drop expired previous key: %+v", err)
+				return err
+			}
+			return nil
+		}
+
+		entity, err := readEntity(key.PreviousArmoredKey)
+		if err != nil {
+			log.Errorf(tc, "Unable to parse previous key: %+v", err)
+			return err
+		}
+
+		err = key.replaceArmoredKey(entity, key.PreviousArmoredKey)
+		if err != nil {
+			return err
+		}
+		key.PreviousArmoredKey = ""
+		key.RollbackExpiresAt = time.Time{}
+
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to save rolled back key: %+v", err)
+			return err
+		}
+
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return Key{}, err
+	}
+
+	if expired {
+		return Key{}, echo.NewHTTPError(http.StatusBadRequest, "It is too late to roll back the password change")
+	}
+
+	key.ID = keyKey
+	events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+
+	return key, nil
+}
+
+// PurgeExpiredRollbacks drops the previous wrapping of password keys whose rollback window has passed
+func PurgeExpiredRollbacks(ctx context.Context) error {
+	query := datastore.NewQuery(keyEntityType).
+		Filter("RollbackExpiresAt >", time.Time{}).
+		Filter("RollbackExpiresAt <", time.Now()).
+		KeysOnly()
+	keyKeys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query expired rollbacks: %+v", err)
+		return err
+	}
+
+	for _, keyKey := range keyKeys {
+		err = purgeRollback(ctx, keyKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func purgeRollback(ctx context.Context, keyKey *datastore.Key) error {
+	purged := false
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		purged = false
+		var key Key
+		err := datastore.Get(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to purge rollback: %+v", err)
+			return err
+		}
+
+		// the password may have been changed again since the query
+		if key.RollbackExpiresAt.IsZero() || time.Now().Before(key.RollbackExpiresAt) {
+			return nil
+		}
+
+		migrating, err := ownerMigrating(tc, keyKey)
+		if err != nil || migrating {
+			return err
+		}
+
+		key.PreviousArmoredKey = ""
+		key.RollbackExpiresAt = time.Time{}
+		_, err = datastore.Put(tc, keyKey, &key)
+		if err != nil {
+			log.Errorf(tc, "Unable to purge previous key: %+v", err)
+			return err
+		}
+
+		purged = true
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	if purged {
+		events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: keyKey.Encode()})
+	}
+
+	return nil
+}
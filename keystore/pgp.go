@@ -0,0 +1,325 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// A Subkey is an encryption capable subkey of a key
+type Subkey struct {
+	Fingerprint string    `json:"fingerprint"`
+	KeyID       string    `json:"keyId"`
+	Algorithm   string    `json:"algorithm"`
+	BitLength   int       `json:"bitLength"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"` // zero if the subkey never expires
+}
+
+// readEntity parses an armored key, which must contain exactly one key
+func readEntity(armored string) (*openpgp.Entity, error) {
+	return selectEntity(armored, "")
+}
+
+// selectEntity parses an armored keyring and picks the key with a fingerprint.
+// Without a fingerprint, the keyring must contain exactly one key.
+func selectEntity(armored, fpr string) (*openpgp.Entity, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+
+	if fpr == "" {
+		if len(entities) != 1 {
+			return nil, fmt.Errorf("Expected exactly one key, found %d", len(entities))
+		}
+		return entities[0], nil
+	}
+
+	for _, entity := range entities {
+		if fingerprint(entity.PrimaryKey) == strings.ToUpper(fpr) {
+			return entity, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No key with fingerprint %s", fpr)
+}
+
+// armorPublicKey armors the public parts of entities as a single keyring
+func armorPublicKey(entities ...*openpgp.Entity) (string, error) {
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return "", err
+	}
+
+	for _, entity := range entities {
+		err = entity.Serialize(w)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+// setMetadata fills in the metadata of a key from its parsed entity
+func (k *Key) setMetadata(entity *openpgp.Entity) error {
+	pk := entity.PrimaryKey
+	selfSig, _ := entity.PrimarySelfSignature()
+	if selfSig == nil {
+		return errors.New("Key has no valid self signature")
+	}
+
+	k.Fingerprint = fingerprint(pk)
+	k.KeyID = keyID(pk)
+	k.Algorithm = algorithmName(pk)
+	k.BitLength = bitLength(pk)
+	k.KeyCreatedAt = pk.CreationTime
+	k.ExpiresAt = expiry(pk, selfSig)
+
+	k.UserIDs = []string{}
+	for name := range entity.Identities {
+		k.UserIDs = append(k.UserIDs, name)
+	}
+	sort.Strings(k.UserIDs)
+
+	k.Subkeys = []Subkey{}
+	for _, sk := range entity.Subkeys {
+		if !canEncrypt(sk) {
+			continue
+		}
+
+		k.Subkeys = append(k.Subkeys, Subkey{
+			Fingerprint: fingerprint(sk.PublicKey),
+			KeyID:       keyID(sk.PublicKey),
+			Algorithm:   algorithmName(sk.PublicKey),
+			BitLength:   bitLength(sk.PublicKey),
+			CreatedAt:   sk.PublicKey.CreationTime,
+			ExpiresAt:   expiry(sk.PublicKey, sk.Sig),
+		})
+	}
+
+	k.EncryptionExpiresAt = k.encryptionExpiry()
+	k.ExpiryReminderDays = 0
+
+	return nil
+}
+
+// clearMetadata removes the metadata of a key, e.g. any sent by a client
+func (k *Key) clearMetadata() {
+	k.Fingerprint = ""
+	k.KeyID = ""
+	k.Algorithm = ""
+	k.BitLength = 0
+	k.KeyCreatedAt = time.Time{}
+	k.ExpiresAt = time.Time{}
+	k.UserIDs = nil
+	k.Subkeys = nil
+	k.EncryptionExpiresAt = time.Time{}
+	k.ExpiryReminderDays = 0
+}
+
+// sameMetadata checks if two keys have the same metadata
+func (k Key) sameMetadata(other Key) bool {
+	if k.Fingerprint != other.Fingerprint ||
+		k.KeyID != other.KeyID ||
+		k.Algorithm != other.Algorithm ||
+		k.BitLength != other.BitLength ||
+		!k.KeyCreatedAt.Equal(other.KeyCreatedAt) ||
+		!k.ExpiresAt.Equal(other.ExpiresAt) ||
+		!k.EncryptionExpiresAt.Equal(other.EncryptionExpiresAt) ||
+		len(k.UserIDs) != len(other.UserIDs) ||
+		len(k.Subkeys) != len(other.Subkeys) {
+		return false
+	}
+
+	for idx := range k.UserIDs {
+		if k.UserIDs[idx] != other.UserIDs[idx] {
+			return false
+		}
+	}
+
+	for idx, sk := range k.Subkeys {
+		o := other.Subkeys[idx]
+		if sk.Fingerprint != o.Fingerprint ||
+			sk.KeyID != o.KeyID ||
+			sk.Algorithm != o.Algorithm ||
+			sk.BitLength != o.BitLength ||
+			!sk.CreatedAt.Equal(o.CreatedAt) ||
+			!sk.ExpiresAt.Equal(o.ExpiresAt) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameEncryptionSubkeys checks if an entity has exactly the encryption subkeys in subkeys
+func sameEncryptionSubkeys(entity *openpgp.Entity, subkeys []Subkey) bool {
+	fingerprints := map[string]bool{}
+	for _, sk := range subkeys {
+		fingerprints[sk.Fingerprint] = true
+	}
+
+	found := 0
+	for _, sk := range entity.Subkeys {
+		if !canEncrypt(sk) {
+			continue
+		}
+		if !fingerprints[fingerprint(sk.PublicKey)] {
+			return false
+		}
+		found++
+	}
+
+	return found == len(fingerprints)
+}
+
+// subkeyIDs gets the key ids of a keys encryption subkeys
+func (k Key) subkeyIDs() map[string]bool {
+	ids := map[string]bool{}
+	for _, sk := range k.Subkeys {
+		ids[sk.KeyID] = true
+	}
+	return ids
+}
+
+// recipientKeyIDs gets the key ids an armored message is encrypted to
+func recipientKeyIDs(armored string) ([]string, error) {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []string{}
+	packets := packet.NewReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		encryptedKey, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			// the session keys come before the encrypted data
+			break
+		}
+		ids = append(ids, fmt.Sprintf("%016X", encryptedKey.KeyId))
+	}
+
+	if len(ids) == 0 {
+		return nil, errors.New("Message is not encrypted to any keys")
+	}
+	return ids, nil
+}
+
+// encryptionExpiry gets when a key can no longer be encrypted to, which is when either
+// the primary key or the last of its encryption subkeys expires, or zero if never
+func (k Key) encryptionExpiry() time.Time {
+	var subkeysExpiry time.Time
+	for idx, sk := range k.Subkeys {
+		if sk.ExpiresAt.IsZero() {
+			subkeysExpiry = time.Time{}
+			break
+		}
+		if idx == 0 || sk.ExpiresAt.After(subkeysExpiry) {
+			subkeysExpiry = sk.ExpiresAt
+		}
+	}
+
+	if k.ExpiresAt.IsZero() {
+		return subkeysExpiry
+	}
+	if subkeysExpiry.IsZero() || k.ExpiresAt.Before(subkeysExpiry) {
+		return k.ExpiresAt
+	}
+	return subkeysExpiry
+}
+
+// canEncrypt checks whether a subkey is flagged for encryption by its binding signature
+func canEncrypt(sk openpgp.Subkey) bool {
+	return sk.Sig != nil &&
+		sk.Sig.FlagsValid &&
+		(sk.Sig.FlagEncryptCommunications || sk.Sig.FlagEncryptStorage) &&
+		sk.PublicKey.PubKeyAlgo.CanEncrypt() &&
+		len(sk.Revocations) == 0
+}
+
+func fingerprint(pk *packet.PublicKey) string {
+	return fmt.Sprintf("%X", pk.Fingerprint)
+}
+
+func keyID(pk *packet.PublicKey) string {
+	return fmt.Sprintf("%016X", pk.KeyId)
+}
+
+func bitLength(pk *packet.PublicKey) int {
+	bits, err := pk.BitLength()
+	if err != nil {
+		return 0
+	}
+	return int(bits)
+}
+
+// expiry gets the time a key expires according to its self signature, or zero if it never expires
+func expiry(pk *packet.PublicKey, sig *packet.Signature) time.Time {
+	if sig == nil || sig.KeyLifetimeSecs == nil || *sig.KeyLifetimeSecs == 0 {
+		return time.Time{}
+	}
+	return pk.CreationTime.Add(time.Duration(*sig.KeyLifetimeSecs) * time.Second)
+}
+
+func algorithmName(pk *packet.PublicKey) string {
+	var name string
+	switch pk.PubKeyAlgo {
+	case packet.PubKeyAlgoRSA, packet.PubKeyAlgoRSAEncryptOnly, packet.PubKeyAlgoRSASignOnly:
+		name = "RSA"
+	case packet.PubKeyAlgoDSA:
+		name = "DSA"
+	case packet.PubKeyAlgoElGamal:
+		name = "ElGamal"
+	case packet.PubKeyAlgoECDH:
+		name = "ECDH"
+	case packet.PubKeyAlgoECDSA:
+		name = "ECDSA"
+	case packet.PubKeyAlgoEdDSA:
+		name = "EdDSA"
+	case packet.PubKeyAlgoX25519:
+		name = "X25519"
+	case packet.PubKeyAlgoX448:
+		name = "X448"
+	case packet.PubKeyAlgoEd25519:
+		name = "Ed25519"
+	case packet.PubKeyAlgoEd448:
+		name = "Ed448"
+	default:
+		return fmt.Sprintf("Unknown (%d)", pk.PubKeyAlgo)
+	}
+
+	// name the curve for the algorithms that can use several
+	switch pk.PubKeyAlgo {
+	case packet.PubKeyAlgoECDH, packet.PubKeyAlgoECDSA, packet.PubKeyAlgoEdDSA:
+		if curve, err := pk.Curve(); err == nil {
+			name = fmt.Sprintf("%s (%s)", name, curve)
+		}
+	}
+
+	return name
+}
@@ -0,0 +1,194 @@
+package keystore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"events"
+	"revisions"
+)
+
+// revocationReasons are the names of the reasons a key can be revoked for
+var revocationReasons = map[packet.ReasonForRevocation]string{
+	packet.NoReason:       "unspecified",
+	packet.KeySuperseded:  "superseded",
+	packet.KeyCompromised: "compromised",
+	packet.KeyRetired:     "retired",
+}
+
+// Revocation is an upload of a keys revocation certificate
+type Revocation struct {
+	Certificate string `json:"certificate"`
+}
+
+// RevocationHandler marks a key as revoked with its revocation certificate.
+// Revoked keys can't be encrypted to, but the entries encrypted with them
+// are kept until the key is deleted with RevokeHandler.
+func RevocationHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	keyKey, err := datastore.DecodeKey(c.Param("id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse id key")
+	}
+
+	// make sure the user owns the key
+	if !keyKey.Parent().Equal(userKey) {
+		return echo.ErrNotFound
+	}
+
+	revocation := Revocation{}
+	err = c.Bind(&revocation)
+	if err != nil || revocation.Certificate == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "A revocation certificate is required")
+	}
+
+	sig, err := readRevocation(revocation.Certificate)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("The provided revocation certificate is not valid: %s", err))
+	}
+
+	keys, err := Revoke(ctx, keyKey, revocation.Certificate, sig)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, keys)
+}
+
+// Revoke verifies a revocation signature against a key and marks the key revoked.
+// The public and private records of the key are both revoked, if the key has a fingerprint.
+func Revoke(ctx context.Context, keyKey *datastore.Key, certificate string, sig *packet.Signature) ([]Key, error) {
+	var key Key
+	err := datastore.Get(ctx, keyKey, &key)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, echo.ErrNotFound
+	}
+	if err != nil {
+		log.Errorf(ctx, "Unable to get key to revoke: %+v", err)
+		return nil, err
+	}
+
+	armored := key.ArmoredKey
+	if key.URL != "" {
+		armored = key.CachedArmoredKey
+	}
+
+	entity, err := readEntity(armored)
+	if err != nil {
+		log.Errorf(ctx, "Unable to parse key to revoke: %+v", err)
+		return nil, err
+	}
+
+	err = entity.PrimaryKey.VerifyRevocationSignature(sig)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "The revocation certificate is not for this key")
+	}
+
+	reason := revocationReasons[packet.NoReason]
+	if sig.RevocationReason != nil {
+		if name, ok := revocationReasons[*sig.RevocationReason]; ok {
+			reason = name
+		}
+	}
+
+	revoked := []Key{}
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		revoked = []Key{}
+		k := &Key{}
+		err := datastore.Get(tc, keyKey, k)
+		if err != nil {
+			log.Errorf(tc, "Unable to get key to revoke: %+v", err)
+			return err
+		}
+		k.ID = keyKey
+		keys := []*Key{k}
+
+		// the other record of the same key can only be found by fingerprint
+		if k.Fingerprint != "" {
+			otherType := private
+			if k.Type == private {
+				otherType = public
+			}
+
+			other, err := getByFingerprint(tc, k.Fingerprint, otherType, keyKey.Parent())
+			if err != nil {
+				return err
+			}
+			if other != nil {
+				keys = append(keys, other)
+			}
+		}
+
+		for _, k := range keys {
+			k.Revoked = true
+			k.RevokedAt = sig.CreationTime
+			k.RevocationReason = reason
+			k.RevocationComment = sig.RevocationReasonText
+			k.RevocationCertificate = certificate
+			_, err = datastore.Put(tc, k.ID, k)
+			if err != nil {
+				log.Errorf(tc, "Unable to save revoked key: %+v", err)
+				return err
+			}
+
+			revoked = append(revoked, *k)
+		}
+
+		_, err = revisions.Increment(tc, keyKey.Parent())
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, k := range revoked {
+		events.Publish(ctx, keyKey.Parent(), events.Event{Type: events.Keys, Action: events.Updated, ID: k.ID.Encode()})
+	}
+
+	return revoked, nil
+}
+
+// readRevocation reads the key revocation signature from an armored revocation certificate
+func readRevocation(certificate string) (*packet.Signature, error) {
+	block, err := armor.Decode(strings.NewReader(certificate))
+	if err != nil {
+		return nil, err
+	}
+
+	reader := packet.NewReader(block.Body)
+	for {
+		p, err := reader.Next()
+		if err == io.EOF {
+			return nil, errors.New("No key revocation signature found")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		sig, ok := p.(*packet.Signature)
+		if ok && sig.SigType == packet.SigTypeKeyRevocation {
+			if sig.CreationTime.After(time.Now()) {
+				return nil, errors.New("The revocation signature was made in the future")
+			}
+			return sig, nil
+		}
+	}
+}
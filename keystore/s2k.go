@@ -0,0 +1,210 @@
+package keystore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	// packet tags of secret keys and subkeys
+	secretKeyTag    = 5
+	secretSubkeyTag = 7
+
+	// s2k usage octets
+	s2kUnencrypted = 0
+	s2kAEAD        = 253
+	s2kChecksum    = 254
+	s2kSHA1        = 255
+
+	// s2k specifier types
+	s2kSimple         = 0
+	s2kSalted         = 1
+	s2kIteratedSalted = 3
+	s2kArgon2         = 4
+	s2kGNU            = 101 // the secret lives on a card or isn't there at all, e.g. yubikey stubs
+
+	// minS2KCount is the fewest bytes an iterated and salted s2k may hash.
+	// openpgp.js and gnupg both default to well above this.
+	minS2KCount = 1 << 20
+)
+
+// strongCiphers are the symmetric ciphers a private key can be protected with
+var strongCiphers = map[byte]string{
+	7:  "AES-128",
+	8:  "AES-192",
+	9:  "AES-256",
+	10: "Twofish",
+	11: "Camellia-128",
+	12: "Camellia-192",
+	13: "Camellia-256",
+}
+
+// checkPrivateKeyProtection makes sure every secret key packet in an armored key
+// is encrypted with a strong cipher and a slow s2k. The library hides how a packet
+// is protected, so the packets are read here.
+func checkPrivateKeyProtection(armored string) error {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		return err
+	}
+
+	found := false
+	reader := packet.NewOpaqueReader(block.Body)
+	for {
+		op, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if op.Tag != secretKeyTag && op.Tag != secretSubkeyTag {
+			continue
+		}
+		found = true
+
+		err = checkSecretKeyPacket(op)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !found {
+		return errors.New("No private key found")
+	}
+
+	return nil
+}
+
+// checkSecretKeyPacket checks how a single secret key packet is protected
+func checkSecretKeyPacket(op *packet.OpaquePacket) error {
+	p, err := op.Parse()
+	if err != nil {
+		return err
+	}
+	pk, ok := p.(*packet.PrivateKey)
+	if !ok {
+		return errors.New("Unable to read private key")
+	}
+
+	// the secret parameters start after the public key
+	offset, err := publicKeyLength(&pk.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	r := bytes.NewReader(op.Contents)
+	_, err = r.Seek(int64(offset), io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	usage, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if usage == s2kUnencrypted {
+		return fmt.Errorf("Private key %s is not protected by a passphrase", keyID(&pk.PublicKey))
+	}
+
+	// newer keys say how many octets of s2k parameters follow
+	if pk.Version >= 5 {
+		_, err = r.ReadByte()
+		if err != nil {
+			return err
+		}
+	}
+
+	if usage != s2kAEAD && usage != s2kChecksum && usage != s2kSHA1 {
+		// the usage octet is the cipher, with an unsalted md5 s2k
+		return fmt.Errorf("Private key %s uses a weak passphrase protection", keyID(&pk.PublicKey))
+	}
+
+	cipher, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	if usage == s2kAEAD {
+		// skip the aead mode
+		_, err = r.ReadByte()
+		if err != nil {
+			return err
+		}
+	}
+
+	// version 6 keys also give the length of the s2k specifier
+	if pk.Version == 6 {
+		_, err = r.ReadByte()
+		if err != nil {
+			return err
+		}
+	}
+
+	return checkS2K(r, cipher, keyID(&pk.PublicKey))
+}
+
+// checkS2K reads an s2k specifier and checks that it and its cipher are strong
+func checkS2K(r *bytes.Reader, cipher byte, id string) error {
+	s2kType, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+
+	switch s2kType {
+	case s2kGNU:
+		// nothing is encrypted with the passphrase
+		return nil
+	case s2kSimple, s2kSalted:
+		return fmt.Errorf("Private key %s uses a weak passphrase protection", id)
+	case s2kIteratedSalted:
+		// skip the hash and salt
+		_, err = r.Seek(1+8, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+
+		count := (16 + int(c&15)) << (uint(c>>4) + 6)
+		if count < minS2KCount {
+			return fmt.Errorf("Private key %s uses a passphrase protection with too few iterations", id)
+		}
+	case s2kArgon2:
+	default:
+		return fmt.Errorf("Private key %s uses an unknown passphrase protection", id)
+	}
+
+	if _, ok := strongCiphers[cipher]; !ok {
+		return fmt.Errorf("Private key %s is encrypted with a weak cipher", id)
+	}
+
+	return nil
+}
+
+// publicKeyLength gets the length of the body of a public key packet
+func publicKeyLength(pk *packet.PublicKey) (int, error) {
+	var buf bytes.Buffer
+	err := pk.Serialize(&buf)
+	if err != nil {
+		return 0, err
+	}
+
+	op, err := packet.NewOpaqueReader(&buf).Next()
+	if err != nil {
+		return 0, err
+	}
+
+	return len(op.Contents), nil
+}
@@ -0,0 +1,129 @@
+package keystore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+const (
+	hashSHA1   = 2
+	hashSHA256 = 8
+
+	cipherCAST5  = 3
+	cipherAES256 = 9
+)
+
+// salt is the s2k salt of every fixture, its value doesnt matter
+var salt = []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+func TestCheckPrivateKeyProtection(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var unencrypted bytes.Buffer
+	w, err := armor.Encode(&unencrypted, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = entity.SerializePrivateWithoutSigning(w, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	pub := &entity.PrivateKey.PublicKey
+	tests := []struct {
+		name  string
+		key   string
+		valid bool
+	}{
+		{"unencrypted", unencrypted.String(), false},
+		{"simple s2k", secretKey(t, pub, s2kChecksum, cipherAES256, []byte{s2kSimple, hashSHA256}), false},
+		{"salted s2k", secretKey(t, pub, s2kChecksum, cipherAES256, append([]byte{s2kSalted, hashSHA256}, salt...)), false},
+		{"low iteration count", secretKey(t, pub, s2kChecksum, cipherAES256, iterated(hashSHA256, 0)), false},
+		{"cast5", secretKey(t, pub, s2kChecksum, cipherCAST5, iterated(hashSHA1, 255)), false},
+		{"gnu stub", secretKey(t, pub, s2kChecksum, cipherAES256, []byte{s2kGNU, hashSHA1, 'G', 'N', 'U', 1}), true},
+		// openpgp.js v3 protects keys with aes-256 and an iterated and salted sha-256 s2k, with count octet 224
+		{"openpgp.js v3 default", secretKey(t, pub, s2kChecksum, cipherAES256, iterated(hashSHA256, 224)), true},
+		{"gnupg default", secretKey(t, pub, s2kChecksum, cipherAES256, iterated(hashSHA256, 255)), true},
+	}
+
+	for _, test := range tests {
+		err := checkPrivateKeyProtection(test.key)
+		if test.valid && err != nil {
+			t.Errorf("%s: expected the key to be accepted, got %v", test.name, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%s: expected the key to be rejected", test.name)
+		}
+	}
+}
+
+func TestCheckPrivateKeyProtectionPublicKey(t *testing.T) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	armored, err := armorPublicKey(entity)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = checkPrivateKeyProtection(armored)
+	if err == nil {
+		t.Error("expected a public key to be rejected")
+	}
+}
+
+// iterated gets an iterated and salted s2k specifier
+func iterated(hash, count byte) []byte {
+	s2k := append([]byte{s2kIteratedSalted, hash}, salt...)
+	return append(s2k, count)
+}
+
+// secretKey armors a version 4 secret key packet for a public key, protected with an s2k.
+// The encrypted secret is random, since only the protection is checked.
+func secretKey(t *testing.T, pub *packet.PublicKey, usage, cipher byte, s2k []byte) string {
+	var body bytes.Buffer
+	err := pub.Serialize(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// drop the public key packet header
+	op, err := packet.NewOpaqueReader(&body).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	contents := append([]byte{}, op.Contents...)
+	contents = append(contents, usage, cipher)
+	contents = append(contents, s2k...)
+	if s2k[0] != s2kGNU {
+		// the iv and encrypted secret
+		contents = append(contents, bytes.Repeat([]byte{0x42}, 48)...)
+	}
+
+	var buf bytes.Buffer
+	w, err := armor.Encode(&buf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new format packet header with a four octet length
+	header := []byte{0xc0 | secretKeyTag, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:], uint32(len(contents)))
+	w.Write(header)
+	w.Write(contents)
+	w.Close()
+
+	return buf.String()
+}
@@ -0,0 +1,44 @@
+package mail
+
+import (
+	"context"
+
+	"github.com/SparkPost/gosparkpost"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+
+	"config"
+)
+
+// Send sends an html email to a single recipient
+func Send(ctx context.Context, to, subject, html string) error {
+	cfg := &gosparkpost.Config{
+		BaseUrl:    "https://api.sparkpost.com",
+		ApiKey:     config.SparkPostAPIKey,
+		ApiVersion: 1,
+	}
+	var client gosparkpost.Client
+	err := client.Init(cfg)
+	if err != nil {
+		log.Errorf(ctx, "SparkPost client init failed: %+v", err)
+		return err
+	}
+
+	// Create a Transmission using an inline Recipient List
+	// and inline email Content.
+	tx := &gosparkpost.Transmission{
+		Recipients: []string{to},
+		Content: gosparkpost.Content{
+			HTML:    html,
+			From:    config.VerifyEmailFrom,
+			Subject: subject,
+		},
+	}
+	client.Client = urlfetch.Client(ctx)
+	_, _, err = client.Send(tx)
+	if err != nil {
+		log.Errorf(ctx, "Unable to send email: %+v", err)
+		return err
+	}
+	return nil
+}
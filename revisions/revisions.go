@@ -0,0 +1,99 @@
+package revisions
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	revisionEntityType = "revision"
+	revisionName       = "revision"
+)
+
+type revision struct {
+	R int64
+}
+
+// Get returns a user's current data revision
+func Get(ctx context.Context, userKey *datastore.Key) (int64, error) {
+	var r revision
+	err := datastore.Get(ctx, revisionKey(ctx, userKey), &r)
+	if err == datastore.ErrNoSuchEntity {
+		return 0, nil
+	}
+	if err != nil {
+		log.Errorf(ctx, "Unable to get revision: %+v", err)
+		return 0, err
+	}
+
+	return r.R, nil
+}
+
+// Bump increments a user's data revision and returns the new revision
+func Bump(ctx context.Context, userKey *datastore.Key) (int64, error) {
+	var rev int64
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		var err error
+		rev, err = Increment(tc, userKey)
+		return err
+	}, nil)
+	return rev, err
+}
+
+// Increment increments a user's data revision and returns the new revision.
+// It must be called in a transaction, so that callers can record the
+// revision alongside their own writes.
+func Increment(tc context.Context, userKey *datastore.Key) (int64, error) {
+	rev, err := Get(tc, userKey)
+	if err != nil {
+		return 0, err
+	}
+
+	rev++
+	_, err = datastore.Put(tc, revisionKey(tc, userKey), &revision{rev})
+	if err != nil {
+		log.Errorf(tc, "Unable to put revision: %+v", err)
+		return 0, err
+	}
+
+	return rev, nil
+}
+
+func revisionKey(ctx context.Context, userKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, revisionEntityType, revisionName, 0, userKey)
+}
+
+// CheckETag sets a strong ETag on the response and reports whether the request's
+// If-None-Match already has it. The ETag is derived from the user's data revision
+// and the request URI, so it changes whenever any of the user's data does.
+func CheckETag(c echo.Context, userKey *datastore.Key) (bool, error) {
+	ctx := appengine.NewContext(c.Request())
+	rev, err := Get(ctx, userKey)
+	if err != nil {
+		return false, err
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%s\n%d", userKey.Encode(), c.Request().URL.RequestURI(), rev)))
+	etag := fmt.Sprintf("\"%s\"", base64.RawURLEncoding.EncodeToString(sum[:]))
+
+	res := c.Response()
+	res.Header().Set("ETag", etag)
+	// make browsers revalidate instead of trusting their cache
+	res.Header().Set("Cache-Control", "private, no-cache")
+
+	for _, match := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if strings.TrimSpace(match) == etag {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -159,28 +159,28 @@ function addToVault(
       return Promise.reject(m);
     }
 
-    // convert all URL keys to armored keys, so they dont get repeatedly requested in the cartesian product
+    // url keys are encrypted to the copy the server fetched and pinned, never to whatever the url serves now
     let armoredKeys;
     try {
-      armoredKeys = List(
-        await Promise.all(
-          keys.map(
-            k =>
-              !!k.get("armoredKey")
-                ? k
-                : // fetch the key, and replace the url with the armored key
-                  dispatch(
-                    fetchArmoredKeyByURL(k.get("id"), k.get("url"))
-                  ).then(armoredKey => k.merge({ url: "", armoredKey }))
-          )
-        )
-      );
+      armoredKeys = keys.map(k => {
+        if (!!k.get("armoredKey")) {
+          return k;
+        }
+        if (!!k.get("fingerprintMismatch")) {
+          const message = `The key at its URL changed from ${k.get("fingerprint")} to ${k.get("fingerprintMismatch")}`;
+          throw Map({ message, key: k.get("id") });
+        }
+        if (!k.get("cachedArmoredKey")) {
+          const message = "The key hasn't been fetched from its URL yet";
+          throw Map({ message, key: k.get("id") });
+        }
+        return k.merge({ url: "", armoredKey: k.get("cachedArmoredKey") });
+      });
     } catch (err) {
       const name = keys.find(k => k.get("id") === err.get("key")).get("name");
       const m = err.update(
         "message",
-        message =>
-          `Failed to fetch key "${name}". Consider checking that the key URL is valid. Error message: ${message}`
+        message => `Unable to encrypt to key "${name}". ${message}`
       );
       dispatch(failureHandler(m));
       throw m;
@@ -224,26 +224,6 @@ function addToVault(
   };
 }
 
-function fetchArmoredKeyByURL(keyID, url) {
-  return function(dispatch) {
-    // keyUrl won't get the raw cert
-    let rawKeyURL = new URL(url);
-    rawKeyURL.searchParams.set("options", "mr");
-    // http reqs must be proxied due to mixed content requirements on chrome. e.g.
-    // sks-keyservers uses their own custom signed cert.
-    // fetch wont fetch over http (mixed content) and wont allow you to pin a cert
-    // so just proxy through vaelt.
-    if (rawKeyURL.protocol === "http:") {
-      let proxyURL = new URL("/api/keys/proxy", window.location);
-      proxyURL.searchParams.set("url", rawKeyURL.toString());
-      rawKeyURL = proxyURL;
-    }
-    return fetch(rawKeyURL)
-      .then(stringResponse(), reqFailure())
-      .then(resp => resp, err => Promise.reject(err.set("key", keyID)));
-  };
-}
-
 export const DELETE_BY_TITLE_REQUEST = "DELETE_BY_TITLE_REQUEST";
 function deleteByTitleRequest(taskID) {
   return {
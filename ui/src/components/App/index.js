@@ -5,6 +5,7 @@ import UnverifiedBar from "./unverifiedBar";
 import Splash from "./splash";
 import Dashboard from "../Dashboard";
 import Redirect from "../Redirect";
+import Reset from "../Reset";
 import "./App.css";
 
 export default class App extends Component {
@@ -16,6 +17,7 @@ export default class App extends Component {
         <Route exact path="/" component={Splash} />
         <Route path="/dashboard" component={Dashboard} />
         <Route path="/redirect/:link" component={Redirect} />
+        <Route path="/reset/:token" component={Reset} />
       </div>
     );
   }
@@ -0,0 +1,108 @@
+import React, { Component } from "react";
+import PropTypes from "prop-types";
+import { jsonResponse } from "../../actions/parseResponse";
+import LoginU2F from "../U2F/login";
+import "./reset.css";
+
+export default class Reset extends Component {
+  static propTypes = {
+    match: PropTypes.shape({
+      params: PropTypes.shape({
+        token: PropTypes.string.isRequired,
+      }).isRequired,
+    }).isRequired,
+  };
+
+  constructor() {
+    super();
+
+    this.state = {
+      newPassword: "",
+      confirmPassword: "",
+    };
+  }
+
+  handleInputChange = event => {
+    const target = event.target;
+
+    this.setState({
+      [target.name]: target.value,
+    });
+  };
+
+  submit = e => {
+    e.preventDefault();
+
+    const { newPassword, confirmPassword } = this.state;
+    const { match: { params: { token } } } = this.props;
+
+    if (newPassword !== confirmPassword) {
+      this.setState({ error: "Passwords do not match" });
+      return;
+    }
+
+    let headers = new Headers();
+    headers.append("Content-Type", "application/json");
+    fetch("/api/users/password/reset/confirm", {
+      method: "POST",
+      credentials: "same-origin",
+      body: JSON.stringify({ token, newPassword }),
+      headers,
+    })
+      .then(jsonResponse())
+      .then(
+        resp => this.setState({ message: resp.get("message"), u2f: false }),
+        error => {
+          // the reset is resubmitted once u2f sign is done
+          if (error.get("message") === "U2F required") {
+            this.setState({ u2f: true, error: undefined });
+            return;
+          }
+          this.setState({ error: error.get("message") });
+        }
+      );
+  };
+
+  render() {
+    const { newPassword, confirmPassword, error, message, u2f } = this.state;
+
+    return (
+      <div className="resetPage">
+        <div className="whiteContainer">
+          {message ? (
+            <div className="resetMessage">
+              <div>Your password was reset.</div>
+              <div>{message}</div>
+            </div>
+          ) : (
+            <form className="inputContainer">
+              <input
+                type="password"
+                name="newPassword"
+                value={newPassword}
+                onChange={this.handleInputChange}
+                placeholder="New password"
+              />
+              <input
+                type="password"
+                name="confirmPassword"
+                value={confirmPassword}
+                onChange={this.handleInputChange}
+                placeholder="Confirm new password"
+              />
+              {u2f ? <LoginU2F /> : null}
+              {error ? <div className="errorText">{error}</div> : null}
+              <button
+                type="submit"
+                onClick={this.submit}
+                className="submitButton"
+              >
+                Reset password
+              </button>
+            </form>
+          )}
+        </div>
+      </div>
+    );
+  }
+}
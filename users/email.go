@@ -0,0 +1,472 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"config"
+	"keystore"
+	"mail"
+)
+
+const (
+	emailChangeEntityType = "emailChange"
+	emailChangeName       = "change"
+	emailChangeExpiry     = 24 * time.Hour
+
+	// maxBatchSize is the most entities a single datastore call can take
+	maxBatchSize = 500
+	// emailMigrationBudget is how long a cron run spends moving users to their new emails
+	emailMigrationBudget = 5 * time.Minute
+)
+
+// unmigratedKinds are the descendants of a user that are dropped rather than moved when
+// their email changes, because they are tied to the old user key.
+// u2fChallenge is the u2f challenge kind, which users can't import.
+var unmigratedKinds = map[string]bool{
+	"u2fChallenge":          true,
+	passwordResetEntityType: true,
+	emailChangeEntityType:   true,
+}
+
+func init() {
+	keystore.RegisterMigratingCheck(migrating)
+}
+
+// emailChange is a requested change of a users email, waiting for the new address to be verified.
+// Once the move has started, Cursor and Copied record how far it has got.
+type emailChange struct {
+	NewEmail  string
+	TokenHash string
+	ExpiresAt time.Time
+
+	Cursor string `datastore:",noindex"` // where copying the users descendants is up to
+	Copied bool   // whether all of the users descendants have been copied
+}
+
+type changeEmailRequest struct {
+	Email string `json:"email"`
+}
+
+// ChangeEmailHandler emails a link to the new address that completes the change when visited
+func ChangeEmailHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	req := changeEmailRequest{}
+	err := c.Bind(&req)
+	if err != nil || !strings.Contains(req.Email, "@") {
+		return echo.NewHTTPError(http.StatusBadRequest, "A valid email is required")
+	}
+
+	err = checkEmailAvailable(ctx, req.Email)
+	if err != nil {
+		return err
+	}
+
+	token, tokenHash, err := newToken(userKey)
+	if err != nil {
+		log.Errorf(ctx, "Unable to generate email change token: %+v", err)
+		return err
+	}
+
+	change := &emailChange{
+		NewEmail:  req.Email,
+		TokenHash: tokenHash,
+		ExpiresAt: time.Now().Add(emailChangeExpiry),
+	}
+	_, err = datastore.Put(ctx, emailChangeKey(ctx, userKey), change)
+	if err != nil {
+		log.Errorf(ctx, "Unable to save email change: %+v", err)
+		return err
+	}
+
+	verificationLink := fmt.Sprintf("%s/api/users/email/verify/%s", config.ApplicationID, token)
+	html := fmt.Sprintf("<div>Please visit <a href=\"%s\">%s</a> to change your Vaelt email to this address</div>", verificationLink, verificationLink)
+	err = mail.Send(ctx, req.Email, "Vaelt Email Verification", html)
+	if err != nil {
+		log.Errorf(ctx, "Unable to send email change verification: %+v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "Unfortunately we were unable to send a verification email to the new address")
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// VerifyEmailChangeHandler starts an email change. User keys are named by email, so the user
+// and everything under them is moved to a new user key by cron, which logs out all of their sessions.
+// Both users are locked for writes until the move has finished.
+func VerifyEmailChangeHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, secret, err := parseToken(c.Param("token"))
+	if err != nil {
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	change := &emailChange{}
+	err = datastore.Get(ctx, emailChangeKey(ctx, userKey), change)
+	if err != nil || !checkTokenSecret(secret, change.TokenHash) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid or expired email change link")
+	}
+
+	user, err := GetUserByKey(c, userKey)
+	if err != nil {
+		return err
+	}
+
+	// a move that already started has reserved the new email, and is finished even once the link expires
+	if user.MigratingTo != change.NewEmail {
+		if time.Now().After(change.ExpiresAt) {
+			return echo.NewHTTPError(http.StatusBadRequest, "Invalid or expired email change link")
+		}
+
+		err = checkEmailAvailable(ctx, change.NewEmail)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = startEmailMigration(ctx, userKey, userKeyFromEmail(ctx, change.NewEmail))
+	if err != nil {
+		return err
+	}
+
+	// log the user out so they log back in with their new email
+	_ = sessions.ExpireSession(c)
+
+	return c.String(http.StatusAccepted, fmt.Sprintf("Your email is being changed to %s. You can log in with it in a few minutes.", change.NewEmail))
+}
+
+// ContinueEmailMigrations carries on moving users to their new emails. Descendants are copied
+// and then deleted in batches, and the copy records where it is up to, so a move that doesnt
+// finish in one run carries on in the next.
+func ContinueEmailMigrations(ctx context.Context) error {
+	deadline := time.Now().Add(emailMigrationBudget)
+
+	userKeys, err := datastore.NewQuery(userEntityType).
+		Filter("MigratingTo >", "").
+		KeysOnly().
+		GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get users being migrated: %+v", err)
+		return err
+	}
+
+	// keep going on failures so one move doesnt stop the others
+	for _, userKey := range userKeys {
+		if time.Now().After(deadline) {
+			break
+		}
+
+		err = continueEmailMigration(ctx, userKey, deadline)
+		if err != nil {
+			log.Errorf(ctx, "Unable to migrate user %s: %+v", userKey.StringID(), err)
+		}
+	}
+
+	return nil
+}
+
+func continueEmailMigration(ctx context.Context, from *datastore.Key, deadline time.Time) error {
+	user := &User{}
+	err := datastore.Get(ctx, from, user)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get user to migrate: %+v", err)
+		return err
+	}
+	if user.MigratingTo == "" {
+		return nil
+	}
+	to := userKeyFromEmail(ctx, user.MigratingTo)
+
+	change := &emailChange{}
+	err = datastore.Get(ctx, emailChangeKey(ctx, from), change)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get email change to migrate: %+v", err)
+		return err
+	}
+
+	if !change.Copied {
+		copied, err := migrateDescendants(ctx, from, to, change, deadline)
+		if err != nil || !copied {
+			return err
+		}
+	}
+
+	deleted, err := deleteDescendants(ctx, from, deadline)
+	if err != nil || !deleted {
+		return err
+	}
+
+	err = finishEmailMigration(ctx, from, to)
+	if err != nil {
+		return err
+	}
+
+	html := fmt.Sprintf("<div>The email for your Vaelt account was changed from %s to %s. If this wasn't you, contact us right away.</div>", user.Email, user.MigratingTo)
+	err = mail.Send(ctx, user.Email, "Your Vaelt email was changed", html)
+	if err != nil {
+		log.Errorf(ctx, "Unable to notify old email of change: %+v", err)
+	}
+
+	return nil
+}
+
+// startEmailMigration locks the old user and reserves the new email with a copy of the user,
+// which is locked until the move finishes. Starting a move that has already started does nothing.
+func startEmailMigration(ctx context.Context, from, to *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		user := &User{}
+		err := datastore.Get(tc, from, user)
+		if err != nil {
+			log.Errorf(tc, "Unable to get user to migrate: %+v", err)
+			return err
+		}
+		if user.MigratingTo == to.StringID() {
+			return nil
+		}
+		if user.Migrating() {
+			return echo.NewHTTPError(http.StatusConflict, "Account email is being changed")
+		}
+
+		err = datastore.Get(tc, to, &User{})
+		if err == nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Email %s already has an account", to.StringID()))
+		}
+		if err != datastore.ErrNoSuchEntity {
+			log.Errorf(tc, "Unable to check new user key: %+v", err)
+			return err
+		}
+
+		// expiring sessions now stops writes already authenticated against the old user
+		now := time.Now()
+		newUser := *user
+		newUser.Email = to.StringID()
+		newUser.WKDHash = keystore.WKDHash(LocalPart(newUser.Email))
+		newUser.SessionsValidAfter = now
+		newUser.MigratingFrom = user.Email
+		user.SessionsValidAfter = now
+		user.MigratingTo = newUser.Email
+
+		_, err = datastore.PutMulti(tc, []*datastore.Key{from, to}, []*User{user, &newUser})
+		if err != nil {
+			log.Errorf(tc, "Unable to lock users for migration: %+v", err)
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// migrating checks if a user is being moved to or from another email
+func migrating(ctx context.Context, userKey *datastore.Key) (bool, error) {
+	user := &User{}
+	err := datastore.Get(ctx, userKey, user)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get user to check for migration: %+v", err)
+		return false, err
+	}
+	return user.Migrating(), nil
+}
+
+// finishEmailMigration deletes the old user and their email change, and unlocks the new user
+func finishEmailMigration(ctx context.Context, from, to *datastore.Key) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		user := &User{}
+		err := datastore.Get(tc, to, user)
+		if err != nil {
+			log.Errorf(tc, "Unable to get migrated user: %+v", err)
+			return err
+		}
+
+		user.MigratingFrom = ""
+		_, err = datastore.Put(tc, to, user)
+		if err != nil {
+			log.Errorf(tc, "Unable to unlock migrated user: %+v", err)
+			return err
+		}
+
+		err = datastore.DeleteMulti(tc, []*datastore.Key{from, emailChangeKey(tc, from)})
+		if err != nil {
+			log.Errorf(tc, "Unable to delete migrated user: %+v", err)
+		}
+		return err
+	}, &datastore.TransactionOptions{XG: true})
+}
+
+// checkEmailAvailable makes sure no user has an email
+func checkEmailAvailable(ctx context.Context, email string) error {
+	query := datastore.NewQuery(userEntityType).
+		Filter("Email =", email).
+		KeysOnly()
+	keys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Failed to check if user exists: %+v", err)
+		return err
+	}
+	if len(keys) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("Email %s already has an account", email))
+	}
+
+	return nil
+}
+
+// migrateDescendants copies everything under a user key, e.g. keys, vault entries, u2f registrations
+// and counters, to the same place under a new user key. The user itself isn't copied.
+// Ids are kept, so children don't need to be mapped to new parents, and are reserved under
+// the new user so the datastore never allocates them again. Encoded keys still change, since
+// they include the user key. It copies in batches until the deadline, saving its cursor in the
+// email change after each, and returns whether everything has been copied.
+func migrateDescendants(ctx context.Context, from, to *datastore.Key, change *emailChange, deadline time.Time) (bool, error) {
+	changeKey := emailChangeKey(ctx, from)
+	for time.Now().Before(deadline) {
+		query := datastore.NewQuery("").
+			Ancestor(from).
+			Limit(maxBatchSize)
+		if change.Cursor != "" {
+			cursor, err := datastore.DecodeCursor(change.Cursor)
+			if err != nil {
+				log.Errorf(ctx, "Unable to decode migration cursor: %+v", err)
+				return false, err
+			}
+			query = query.Start(cursor)
+		}
+
+		found := 0
+		newKeys := []*datastore.Key{}
+		newEntities := []datastore.PropertyList{}
+		t := query.Run(ctx)
+		for {
+			var entity datastore.PropertyList
+			key, err := t.Next(&entity)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				log.Errorf(ctx, "Unable to get descendants to migrate: %+v", err)
+				return false, err
+			}
+
+			found++
+			if key.Equal(from) || unmigratedKinds[key.Kind()] {
+				continue
+			}
+
+			newKey := rekey(ctx, key, from, to)
+			err = reserveID(ctx, newKey)
+			if err != nil {
+				return false, err
+			}
+
+			newKeys = append(newKeys, newKey)
+			newEntities = append(newEntities, entity)
+		}
+
+		if len(newKeys) > 0 {
+			_, err := datastore.PutMulti(ctx, newKeys, newEntities)
+			if err != nil {
+				log.Errorf(ctx, "Unable to put migrated descendants: %+v", err)
+				return false, err
+			}
+		}
+
+		cursor, err := t.Cursor()
+		if err != nil {
+			log.Errorf(ctx, "Unable to get migration cursor: %+v", err)
+			return false, err
+		}
+		change.Cursor = cursor.String()
+		change.Copied = found < maxBatchSize
+		_, err = datastore.Put(ctx, changeKey, change)
+		if err != nil {
+			log.Errorf(ctx, "Unable to save migration progress: %+v", err)
+			return false, err
+		}
+
+		if change.Copied {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// reserveID stops the datastore allocating a copied id to a new entity
+func reserveID(ctx context.Context, key *datastore.Key) error {
+	if key.IntID() == 0 {
+		return nil
+	}
+
+	err := datastore.AllocateIDRange(ctx, key.Kind(), key.Parent(), key.IntID(), key.IntID())
+	switch err.(type) {
+	case nil:
+		return nil
+	case *datastore.KeyRangeCollisionError, *datastore.KeyRangeContentionError:
+		// the id was copied or reserved by an earlier attempt
+		return nil
+	default:
+		log.Errorf(ctx, "Unable to reserve migrated id: %+v", err)
+		return err
+	}
+}
+
+// deleteDescendants deletes everything under a user key in batches until the deadline, and
+// returns whether everything has been deleted. The user and their email change are kept until
+// the move finishes.
+func deleteDescendants(ctx context.Context, userKey *datastore.Key, deadline time.Time) (bool, error) {
+	for time.Now().Before(deadline) {
+		batch, err := datastore.NewQuery("").
+			Ancestor(userKey).
+			Limit(maxBatchSize).
+			KeysOnly().
+			GetAll(ctx, nil)
+		if err != nil {
+			log.Errorf(ctx, "Unable to get descendants to delete: %+v", err)
+			return false, err
+		}
+
+		keys := []*datastore.Key{}
+		for _, key := range batch {
+			if !key.Equal(userKey) && !key.Equal(emailChangeKey(ctx, userKey)) {
+				keys = append(keys, key)
+			}
+		}
+		if len(keys) == 0 {
+			return true, nil
+		}
+
+		err = datastore.DeleteMulti(ctx, keys)
+		if err != nil {
+			log.Errorf(ctx, "Unable to delete migrated descendants: %+v", err)
+			return false, err
+		}
+	}
+
+	return false, nil
+}
+
+// rekey moves a key from under one ancestor to under another, keeping the rest of its path
+func rekey(ctx context.Context, key, from, to *datastore.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	if key.Equal(from) {
+		return to
+	}
+	return datastore.NewKey(ctx, key.Kind(), key.StringID(), key.IntID(), rekey(ctx, key.Parent(), from, to))
+}
+
+func emailChangeKey(ctx context.Context, userKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, emailChangeEntityType, emailChangeName, 0, userKey)
+}
@@ -0,0 +1,86 @@
+package users
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"mail"
+)
+
+type changePasswordRequest struct {
+	OldPassword string `json:"oldPassword"`
+	NewPassword string `json:"newPassword"`
+}
+
+// ChangePasswordHandler changes a users password and expires their other sessions.
+// The password private key is rewrapped separately through the keystore.
+func ChangePasswordHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	req := changePasswordRequest{}
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse request body")
+	}
+
+	if req.NewPassword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "A new password is required")
+	}
+
+	user, err := GetUserByKey(c, userKey)
+	if err != nil {
+		return err
+	}
+
+	err = bcrypt.CompareHashAndPassword(user.PasswordHash, []byte(req.OldPassword))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusUnauthorized, "Invalid password")
+	}
+
+	err = setPassword(c, user, req.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	// keep this session, which just proved it knows the password
+	scope, _ := sessions.GetScopeFromContext(c)
+	err = sessions.UpdateSession(c, userKey, scope)
+	if err != nil {
+		return err
+	}
+
+	html := fmt.Sprintf("<div>The password for your Vaelt account %s was changed on %s. If this wasn't you, reset your password right away.</div>", user.Email, time.Now().UTC().Format(time.RFC1123))
+	err = mail.Send(ctx, user.Email, "Your Vaelt password was changed", html)
+	if err != nil {
+		log.Errorf(ctx, "Unable to send password change email: %+v", err)
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// setPassword rehashes and saves a users password, and expires all of their sessions
+func setPassword(c echo.Context, user *User, password string) error {
+	ctx := appengine.NewContext(c.Request())
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Errorf(ctx, "Unable to hash password")
+		return err
+	}
+
+	user.PasswordHash = hashedPassword
+	user.SessionsValidAfter = time.Now()
+	_, err = Save(ctx, user)
+	return err
+}
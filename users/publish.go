@@ -0,0 +1,92 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"keystore"
+)
+
+type publishKeysRequest struct {
+	PublishKeys bool `json:"publishKeys"`
+}
+
+// PublishKeysHandler opts a user in or out of serving their public keys
+// over web key directory and hkp
+func PublishKeysHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	req := publishKeysRequest{}
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse request body")
+	}
+
+	user, err := GetUserByKey(c, userKey)
+	if err != nil {
+		return err
+	}
+
+	// only publish keys for addresses the user has proven they own
+	if req.PublishKeys && !user.Verified {
+		return echo.NewHTTPError(http.StatusForbidden, "Verify your email before publishing your keys")
+	}
+
+	user.PublishKeys = req.PublishKeys
+	user.WKDHash = keystore.WKDHash(LocalPart(user.Email))
+	_, err = Save(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, user)
+}
+
+// GetPublishedUsersByWKDHash gets the verified users that publish their keys with a web key directory hash
+func GetPublishedUsersByWKDHash(ctx context.Context, hash string) ([]*datastore.Key, []User, error) {
+	var results []User
+	query := datastore.NewQuery(userEntityType).
+		Filter("WKDHash =", hash)
+	keys, err := query.GetAll(ctx, &results)
+	if err != nil {
+		log.Errorf(ctx, "Failed to query users by wkd hash: %+v", err)
+		return nil, nil, err
+	}
+
+	publishedKeys := []*datastore.Key{}
+	published := []User{}
+	for idx, user := range results {
+		if user.PublishKeys && user.Verified {
+			publishedKeys = append(publishedKeys, keys[idx])
+			published = append(published, user)
+		}
+	}
+
+	return publishedKeys, published, nil
+}
+
+// LocalPart gets the part of an email address before the @
+func LocalPart(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return email
+	}
+	return email[:at]
+}
+
+// Domain gets the lowercased part of an email address after the @
+func Domain(email string) string {
+	return strings.ToLower(email[strings.LastIndex(email, "@")+1:])
+}
@@ -0,0 +1,289 @@
+package users
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/scopes"
+	"auth/sessions"
+	"config"
+	"mail"
+)
+
+const (
+	passwordResetEntityType = "passwordReset"
+	passwordResetName       = "reset"
+	passwordResetExpiry     = time.Hour
+	tokenSecretSize         = 32
+
+	// passwordResetInterval is how long a user has to wait between reset emails
+	passwordResetInterval = 10 * time.Minute
+
+	// resetNotice explains what a password reset can't do
+	resetNotice = "Resetting your password only restores your login. Your vault entries stay encrypted under your keystore keys, and your password key is still protected by your old password, so decrypt with another key such as a yubikey or your old password."
+)
+
+// passwordReset is an outstanding password reset for a user. Only a hash of the token is stored.
+// A user has at most one, which is deleted when it is used.
+type passwordReset struct {
+	TokenHash string
+	CreatedAt time.Time
+	ExpiresAt time.Time
+}
+
+// errResetTooSoon is returned when a user asks for another reset email too soon after the last one
+var errResetTooSoon = errors.New("A password reset was requested too recently")
+
+type requestResetRequest struct {
+	Email string `json:"email"`
+}
+
+type resetPasswordRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"newPassword"`
+}
+
+// RequestPasswordResetHandler emails a password reset link.
+// It always succeeds so it can't be used to find out who has an account.
+func RequestPasswordResetHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	req := requestResetRequest{}
+	err := c.Bind(&req)
+	if err != nil || req.Email == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "An email is required")
+	}
+
+	userKey, _, err := GetUserByEmail(ctx, req.Email)
+	if err != nil {
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	// failures are only logged, so the response doesnt depend on the account
+	token, err := newPasswordReset(ctx, userKey)
+	if err == errResetTooSoon {
+		log.Infof(ctx, "Not sending another password reset email: %+v", err)
+		return c.NoContent(http.StatusAccepted)
+	}
+	if err != nil {
+		log.Errorf(ctx, "Unable to create password reset: %+v", err)
+		return c.NoContent(http.StatusAccepted)
+	}
+
+	resetLink := fmt.Sprintf("%s/reset/%s", config.ApplicationID, token)
+	html := fmt.Sprintf("<div>Please visit <a href=\"%s\">%s</a> within an hour to reset your password.</div><div>%s</div>", resetLink, resetLink, resetNotice)
+	err = mail.Send(ctx, req.Email, "Vaelt Password Reset", html)
+	if err != nil {
+		log.Errorf(ctx, "Unable to send password reset email: %+v", err)
+	}
+
+	return c.NoContent(http.StatusAccepted)
+}
+
+// ResetPasswordHandler sets a new password with a reset token, and expires all of the users sessions.
+// Users who enforce u2f must complete u2f sign first, the same way as logging in with u2f.
+func ResetPasswordHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	req := resetPasswordRequest{}
+	err := c.Bind(&req)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse request body")
+	}
+
+	if req.NewPassword == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "A new password is required")
+	}
+
+	userKey, secret, err := parseToken(req.Token)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reset token")
+	}
+
+	user, err := GetUserByKey(c, userKey)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reset token")
+	}
+
+	if user.U2fEnforced && !u2fCompleted(c, userKey) {
+		// the token stands in for the password, so a valid one lets the session go on to u2f sign
+		err = checkPasswordReset(ctx, userKey, secret)
+		if err != nil {
+			return err
+		}
+
+		err = sessions.UpdateSession(c, userKey, scopes.U2fForRead)
+		if err != nil {
+			return err
+		}
+
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "U2F")
+		return echo.NewHTTPError(http.StatusUnauthorized, "U2F required")
+	}
+
+	err = usePasswordReset(ctx, userKey, secret)
+	if err != nil {
+		return err
+	}
+
+	err = setPassword(c, user, req.NewPassword)
+	if err != nil {
+		return err
+	}
+
+	html := fmt.Sprintf("<div>The password for your Vaelt account %s was reset on %s. If this wasn't you, reset your password right away.</div><div>%s</div>", user.Email, time.Now().UTC().Format(time.RFC1123), resetNotice)
+	err = mail.Send(ctx, user.Email, "Your Vaelt password was reset", html)
+	if err != nil {
+		log.Errorf(ctx, "Unable to send password reset email: %+v", err)
+	}
+
+	return c.JSON(http.StatusOK, map[string]string{"message": resetNotice})
+}
+
+// newPasswordReset replaces a users password reset with a new one and returns its token.
+// Only one reset can be made every passwordResetInterval, so reset emails cant be used to spam a user.
+func newPasswordReset(ctx context.Context, userKey *datastore.Key) (string, error) {
+	token, tokenHash, err := newToken(userKey)
+	if err != nil {
+		log.Errorf(ctx, "Unable to generate reset token: %+v", err)
+		return "", err
+	}
+
+	err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		key := passwordResetKey(tc, userKey)
+		existing := &passwordReset{}
+		err := datastore.Get(tc, key, existing)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			log.Errorf(tc, "Unable to get password reset: %+v", err)
+			return err
+		}
+		if err == nil && time.Since(existing.CreatedAt) < passwordResetInterval {
+			return errResetTooSoon
+		}
+
+		reset := &passwordReset{
+			TokenHash: tokenHash,
+			CreatedAt: time.Now(),
+			ExpiresAt: time.Now().Add(passwordResetExpiry),
+		}
+		_, err = datastore.Put(tc, key, reset)
+		if err != nil {
+			log.Errorf(tc, "Unable to save password reset: %+v", err)
+		}
+		return err
+	}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// checkPasswordReset checks a reset token without using it up
+func checkPasswordReset(ctx context.Context, userKey *datastore.Key, secret []byte) error {
+	reset := &passwordReset{}
+	err := datastore.Get(ctx, passwordResetKey(ctx, userKey), reset)
+	if err == datastore.ErrNoSuchEntity {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reset token")
+	}
+	if err != nil {
+		log.Errorf(ctx, "Unable to get password reset: %+v", err)
+		return err
+	}
+
+	if !checkTokenSecret(secret, reset.TokenHash) {
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid reset token")
+	}
+
+	if time.Now().After(reset.ExpiresAt) {
+		return echo.NewHTTPError(http.StatusBadRequest, "The reset token has expired")
+	}
+
+	return nil
+}
+
+// usePasswordReset checks a reset token and deletes it so it can't be used again
+func usePasswordReset(ctx context.Context, userKey *datastore.Key, secret []byte) error {
+	return datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		err := checkPasswordReset(tc, userKey, secret)
+		if err != nil {
+			return err
+		}
+
+		err = datastore.Delete(tc, passwordResetKey(tc, userKey))
+		if err != nil {
+			log.Errorf(tc, "Unable to delete password reset: %+v", err)
+		}
+		return err
+	}, nil)
+}
+
+// u2fCompleted reports whether a session finished u2f sign for a user
+func u2fCompleted(c echo.Context, userKey *datastore.Key) bool {
+	sessionUserKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok || !sessionUserKey.Equal(userKey) {
+		return false
+	}
+
+	scope, ok := sessions.GetScopeFromContext(c)
+	return ok && (scope == scopes.Read || scope == scopes.Write)
+}
+
+// newToken makes an emailed token for a user, and the hash of its secret to store
+func newToken(userKey *datastore.Key) (string, string, error) {
+	secret := make([]byte, tokenSecretSize)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", "", err
+	}
+
+	return userKey.Encode() + "." + base64.RawURLEncoding.EncodeToString(secret), hashTokenSecret(secret), nil
+}
+
+// parseToken splits an emailed token into the user it is for and its secret
+func parseToken(token string) (*datastore.Key, []byte, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("Malformed token")
+	}
+
+	userKey, err := datastore.DecodeKey(parts[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	secret, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return userKey, secret, nil
+}
+
+// checkTokenSecret reports whether a token secret matches a stored hash
+func checkTokenSecret(secret []byte, tokenHash string) bool {
+	return subtle.ConstantTimeCompare([]byte(tokenHash), []byte(hashTokenSecret(secret))) == 1
+}
+
+func hashTokenSecret(secret []byte) string {
+	sum := sha256.Sum256(secret)
+	return hex.EncodeToString(sum[:])
+}
+
+func passwordResetKey(ctx context.Context, userKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, passwordResetEntityType, passwordResetName, 0, userKey)
+}
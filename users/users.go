@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo"
 	"golang.org/x/crypto/bcrypt"
@@ -32,6 +33,16 @@ type User struct {
 	PasswordHash []byte `json:"passwordHash"`
 	U2fEnforced  bool   `json:"u2fEnforced"`
 	Verified     bool   `json:"verified"`
+	PublishKeys  bool   `json:"publishKeys"` // whether the users public keys are served over wkd and hkp
+	WKDHash      string `json:"wkdHash"`     // the web key directory hash of the emails local part
+
+	// SessionsValidAfter is when the password last changed. Sessions authenticated before then are expired.
+	SessionsValidAfter time.Time `json:"-"`
+
+	// MigratingTo and MigratingFrom are the other email while the user is moved to a new email.
+	// Writes are rejected on both users until the move has finished.
+	MigratingTo   string `json:"-"`
+	MigratingFrom string `json:"-"`
 }
 
 // RegisterHandler registers a new user
@@ -169,6 +180,11 @@ func GetUserByKey(c echo.Context, key *datastore.Key) (*User, error) {
 	return u, err
 }
 
+// Migrating is whether the user is being moved to or from another email
+func (u *User) Migrating() bool {
+	return u.MigratingTo != "" || u.MigratingFrom != ""
+}
+
 // Save saves a user
 func Save(ctx context.Context, user *User) (*datastore.Key, error) {
 	userKey := userKeyFromEmail(ctx, user.Email)
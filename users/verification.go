@@ -6,46 +6,22 @@ import (
 	"net/http"
 	"net/url"
 
-	"github.com/SparkPost/gosparkpost"
 	"github.com/labstack/echo"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
-	"google.golang.org/appengine/urlfetch"
 
 	"auth/sessions"
 	"config"
+	"mail"
 )
 
 func requestVerification(c echo.Context, userKey *datastore.Key, email string) error {
 	ctx := appengine.NewContext(c.Request())
 
-	cfg := &gosparkpost.Config{
-		BaseUrl:    "https://api.sparkpost.com",
-		ApiKey:     config.SparkPostAPIKey,
-		ApiVersion: 1,
-	}
-	var client gosparkpost.Client
-	err := client.Init(cfg)
-	if err != nil {
-		log.Errorf(ctx, "SparkPost client init failed: %+v", err)
-		return err
-	}
-
 	verificationLink := fmt.Sprintf("%s/api/users/verify/%s", config.ApplicationID, userKey.Encode())
-
-	// Create a Transmission using an inline Recipient List
-	// and inline email Content.
-	tx := &gosparkpost.Transmission{
-		Recipients: []string{email},
-		Content: gosparkpost.Content{
-			HTML:    fmt.Sprintf("<div>Please visit <a href=\"%s\">%s</a> to verify your account</div>", verificationLink, verificationLink),
-			From:    config.VerifyEmailFrom,
-			Subject: "Vaelt Email Verification",
-		},
-	}
-	client.Client = urlfetch.Client(ctx)
-	_, _, err = client.Send(tx)
+	html := fmt.Sprintf("<div>Please visit <a href=\"%s\">%s</a> to verify your account</div>", verificationLink, verificationLink)
+	err := mail.Send(ctx, email, "Vaelt Email Verification", html)
 	if err != nil {
 		log.Errorf(ctx, "Unable to send verification email: %+v", err)
 		return err
@@ -0,0 +1,152 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+	"events"
+	"revisions"
+)
+
+const (
+	changeEntityType = "vaultChange"
+
+	opCreated = "created"
+	opUpdated = "updated"
+	opDeleted = "deleted"
+)
+
+// A Change records the latest write to a title, so clients can keep an offline copy in sync.
+// Deleted titles keep their change as a tombstone.
+type Change struct {
+	Title      string    `json:"title"`
+	TitleIndex string    `json:"titleIndex"`
+	Op         string    `json:"op"` // either created, updated or deleted
+	Revision   int64     `json:"revision"`
+	Time       time.Time `json:"time"`
+	Entries    []Entry   `datastore:"-" json:"entries,omitempty"`
+}
+
+type changesResponse struct {
+	Changes []Change `json:"changes"`
+	Cursor  string   `json:"cursor"`
+}
+
+// ChangesHandler gets the titles that changed after the since cursor, along with
+// the current entries of titles that werent deleted.
+// Without since, no changes are returned and the cursor is the current revision, so
+// clients can take a cursor, load the whole vault and then sync from the cursor.
+func ChangesHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	if c.QueryParam("since") == "" {
+		rev, err := revisions.Get(ctx, userKey)
+		if err != nil {
+			return err
+		}
+
+		return c.JSON(http.StatusOK, changesResponse{Changes: []Change{}, Cursor: strconv.FormatInt(rev, 10)})
+	}
+
+	since, err := strconv.ParseInt(c.QueryParam("since"), 10, 64)
+	if err != nil || since < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse the since cursor")
+	}
+
+	changes := []Change{}
+	query := datastore.NewQuery(changeEntityType).
+		Ancestor(userKey).
+		Filter("Revision >", since).
+		Order("Revision")
+	_, err = query.GetAll(ctx, &changes)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get changes: %+v", err)
+		return err
+	}
+
+	// the cursor is the last revision seen rather than the current revision,
+	// so changes committed while this request is running arent skipped
+	cursor := since
+	for idx := range changes {
+		if changes[idx].Op != opDeleted {
+			filter, title := Entry{Title: changes[idx].Title, TitleIndex: changes[idx].TitleIndex}.titleLookup()
+			changes[idx].Entries, err = getByTitleLookup(ctx, filter, title, userKey)
+			if err != nil {
+				return err
+			}
+		}
+		cursor = changes[idx].Revision
+	}
+
+	return c.JSON(http.StatusOK, changesResponse{Changes: changes, Cursor: strconv.FormatInt(cursor, 10)})
+}
+
+func newChange(title Entry, op string) Change {
+	return Change{
+		Title:      title.Title,
+		TitleIndex: title.TitleIndex,
+		Op:         op,
+	}
+}
+
+// recordChanges bumps the users revision and records the changes under it.
+// It must be called in a transaction, along with the writes it records.
+func recordChanges(tc context.Context, changes []Change, userKey *datastore.Key) (int64, error) {
+	if len(changes) == 0 {
+		return 0, nil
+	}
+
+	rev, err := revisions.Increment(tc, userKey)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := []*datastore.Key{}
+	for idx := range changes {
+		changes[idx].Revision = rev
+		changes[idx].Time = time.Now()
+		keys = append(keys, changeKey(tc, changes[idx], userKey))
+	}
+
+	_, err = datastore.PutMulti(tc, keys, changes)
+	if err != nil {
+		log.Errorf(tc, "Unable to put changes: %+v", err)
+		return 0, err
+	}
+
+	return rev, nil
+}
+
+// publishChanges lets clients know about changes once their transaction has committed
+func publishChanges(ctx context.Context, changes []Change, userKey *datastore.Key) {
+	for _, change := range changes {
+		id := change.Title
+		if change.TitleIndex != "" {
+			id = change.TitleIndex
+		}
+		events.Publish(ctx, userKey, events.Event{Type: events.Vault, Action: change.Op, ID: id, Revision: change.Revision})
+	}
+}
+
+// changeKey keys changes by title so each title only has its latest change
+func changeKey(ctx context.Context, change Change, userKey *datastore.Key) *datastore.Key {
+	name := "title:" + change.Title
+	if change.TitleIndex != "" {
+		name = "index:" + change.TitleIndex
+	}
+	return datastore.NewKey(ctx, changeEntityType, name, 0, userKey)
+}
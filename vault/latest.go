@@ -0,0 +1,89 @@
+package vault
+
+import (
+	"context"
+	"time"
+
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"revisions"
+)
+
+const (
+	migrationEntityType = "migration"
+	latestMigrationName = "latest"
+)
+
+// A migration records that a backfill has finished
+type migration struct {
+	Finished time.Time
+}
+
+// BackfillLatest flags the latest version of every title written before entries
+// were flagged, so latest=true listings include them. It records when it
+// has finished, so running it again does nothing.
+func BackfillLatest(ctx context.Context) error {
+	doneKey := datastore.NewKey(ctx, migrationEntityType, latestMigrationName, 0, nil)
+	err := datastore.Get(ctx, doneKey, &migration{})
+	if err == nil {
+		return nil
+	}
+	if err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to get latest migration: %+v", err)
+		return err
+	}
+
+	// entries are stored under their key, under the user
+	keys, err := datastore.NewQuery(entryEntityType).KeysOnly().GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get all vault entry keys: %+v", err)
+		return err
+	}
+
+	userKeys := []*datastore.Key{}
+	seen := map[string]bool{}
+	for _, key := range keys {
+		userKey := key.Parent().Parent()
+		if !seen[userKey.Encode()] {
+			seen[userKey.Encode()] = true
+			userKeys = append(userKeys, userKey)
+		}
+	}
+
+	for _, userKey := range userKeys {
+		err = backfillUserLatest(ctx, userKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = datastore.Put(ctx, doneKey, &migration{Finished: time.Now()})
+	if err != nil {
+		log.Errorf(ctx, "Unable to record latest migration: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+func backfillUserLatest(ctx context.Context, userKey *datastore.Key) error {
+	entries, err := getAll(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	for _, title := range distinctTitles(entries) {
+		filter, value := title.titleLookup()
+		err = datastore.RunInTransaction(ctx, func(tc context.Context) error {
+			return markLatest(tc, filter, value, userKey, nil, nil)
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	// listings may have been cached before the flags were set
+	_, err = revisions.Bump(ctx, userKey)
+	return err
+}
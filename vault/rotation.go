@@ -0,0 +1,213 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	"auth/sessions"
+)
+
+const (
+	rotationPolicyEntityType = "rotationPolicy"
+	rotationPolicyName       = "policy"
+
+	day = 24 * time.Hour
+)
+
+// A RotationPolicy sets how old the latest version of a title can get before it should be rotated
+type RotationPolicy struct {
+	MaxAgeDays  int           `json:"maxAgeDays"`  // for titles without their own policy, 0 for no limit
+	EmailDigest bool          `json:"emailDigest"` // whether to periodically email the stale titles
+	Titles      []TitlePolicy `json:"titles"`
+}
+
+// A TitlePolicy overrides the max age of a single title.
+// Exactly one of Title or TitleIndex should be non-empty.
+type TitlePolicy struct {
+	Title      string `json:"title"`
+	TitleIndex string `json:"titleIndex"`
+	MaxAgeDays int    `json:"maxAgeDays"` // 0 for no limit
+}
+
+// A StaleTitle is a title whose latest version is older than its policy allows
+type StaleTitle struct {
+	Title          string    `json:"title"`
+	TitleIndex     string    `json:"titleIndex"`
+	EncryptedTitle string    `json:"encryptedTitle"`
+	Version        int       `json:"version"`
+	Created        time.Time `json:"created"`
+	MaxAgeDays     int       `json:"maxAgeDays"`
+}
+
+// GetRotationPolicyHandler gets the users rotation policy
+func GetRotationPolicyHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	policy, err := GetRotationPolicy(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, policy)
+}
+
+// PutRotationPolicyHandler replaces the users rotation policy
+func PutRotationPolicyHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	policy := RotationPolicy{}
+	if err := c.Bind(&policy); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "Unable to unmarshal the request body")
+	}
+
+	if policy.MaxAgeDays < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "maxAgeDays cannot be negative")
+	}
+
+	for _, title := range policy.Titles {
+		if (title.Title != "" && title.TitleIndex != "") || (title.Title == "" && title.TitleIndex == "") {
+			return echo.NewHTTPError(http.StatusBadRequest, "Only one of title and titleIndex should be provided")
+		}
+		if title.MaxAgeDays < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, "maxAgeDays cannot be negative")
+		}
+	}
+
+	_, err := datastore.Put(ctx, rotationPolicyKey(ctx, userKey), &policy)
+	if err != nil {
+		log.Errorf(ctx, "Unable to put rotation policy: %+v", err)
+		return err
+	}
+
+	return c.JSON(http.StatusOK, policy)
+}
+
+// StaleHandler gets the titles whose latest version is older than the rotation policy allows
+func StaleHandler(c echo.Context) error {
+	ctx := appengine.NewContext(c.Request())
+
+	userKey, ok := sessions.GetUserKeyFromContext(c)
+	if !ok {
+		return errors.New("Could not get user key from context")
+	}
+
+	stale, err := Stale(ctx, userKey)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, stale)
+}
+
+// GetRotationPolicy gets a users rotation policy, which is empty if they never set one
+func GetRotationPolicy(ctx context.Context, userKey *datastore.Key) (RotationPolicy, error) {
+	policy := RotationPolicy{}
+	err := datastore.Get(ctx, rotationPolicyKey(ctx, userKey), &policy)
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		log.Errorf(ctx, "Unable to get rotation policy: %+v", err)
+		return RotationPolicy{}, err
+	}
+
+	if policy.Titles == nil {
+		policy.Titles = []TitlePolicy{}
+	}
+
+	return policy, nil
+}
+
+// DigestUserKeys gets the keys of all users who want their stale titles emailed
+func DigestUserKeys(ctx context.Context) ([]*datastore.Key, error) {
+	query := datastore.NewQuery(rotationPolicyEntityType).
+		Filter("EmailDigest =", true).
+		KeysOnly()
+	keys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get rotation policies with digests: %+v", err)
+		return nil, err
+	}
+
+	userKeys := []*datastore.Key{}
+	for _, key := range keys {
+		userKeys = append(userKeys, key.Parent())
+	}
+
+	return userKeys, nil
+}
+
+// Stale gets the titles whose latest version is older than the users rotation policy allows
+func Stale(ctx context.Context, userKey *datastore.Key) ([]StaleTitle, error) {
+	policy, err := GetRotationPolicy(ctx, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := getAll(ctx, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// find the newest entry of the latest version of each title
+	latest := map[string]Entry{}
+	order := []string{}
+	for _, entry := range entries {
+		filter, title := entry.titleLookup()
+		existing, ok := latest[filter+title]
+		if !ok {
+			order = append(order, filter+title)
+		}
+		if !ok || entry.Version > existing.Version || (entry.Version == existing.Version && entry.Created.After(existing.Created)) {
+			latest[filter+title] = entry
+		}
+	}
+
+	stale := []StaleTitle{}
+	for _, lookup := range order {
+		entry := latest[lookup]
+		maxAgeDays := policy.maxAgeDays(entry)
+		if maxAgeDays == 0 || time.Since(entry.Created) < time.Duration(maxAgeDays)*day {
+			continue
+		}
+
+		stale = append(stale, StaleTitle{
+			Title:          entry.Title,
+			TitleIndex:     entry.TitleIndex,
+			EncryptedTitle: entry.EncryptedTitle,
+			Version:        entry.Version,
+			Created:        entry.Created,
+			MaxAgeDays:     maxAgeDays,
+		})
+	}
+
+	return stale, nil
+}
+
+// maxAgeDays gets the max age of an entry's title, preferring the title's own policy
+func (p RotationPolicy) maxAgeDays(entry Entry) int {
+	for _, title := range p.Titles {
+		if title.Title == entry.Title && title.TitleIndex == entry.TitleIndex {
+			return title.MaxAgeDays
+		}
+	}
+	return p.MaxAgeDays
+}
+
+func rotationPolicyKey(ctx context.Context, userKey *datastore.Key) *datastore.Key {
+	return datastore.NewKey(ctx, rotationPolicyEntityType, rotationPolicyName, 0, userKey)
+}
@@ -2,31 +2,64 @@ package vault
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
 	"github.com/labstack/echo"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 
 	"auth/sessions"
+	"revisions"
 )
 
 const (
 	entryEntityType = "entry"
+
+	titleFilter      = "Title ="
+	titleIndexFilter = "TitleIndex ="
+
+	// blindIndexSize is the size of an HMAC-SHA256 digest
+	blindIndexSize = 32
+
+	maxPageSize      = 1000
+	nextCursorHeader = "X-Next-Cursor"
 )
 
-// An Entry is just information stored in the vault
+// An Entry is just information stored in the vault.
+// Exactly one of Title or TitleIndex should be non-empty. Clients that
+// dont want the server to know which services they have accounts with
+// send TitleIndex, an HMAC of the title under a key the server never sees
+// (base64url encoded without padding), along with EncryptedTitle so the
+// title can be recovered client side.
 type Entry struct {
 	Title            string         `json:"title"`
+	TitleIndex       string         `json:"titleIndex"`
+	EncryptedTitle   string         `datastore:",noindex" json:"encryptedTitle"`
 	EncryptedMessage string         `json:"encryptedMessage"`
 	Version          int            `json:"version"`
+	Latest           bool           `json:"latest"` // whether this is the latest version of its title
 	Key              *datastore.Key `json:"key" datastore:"-"`
 	Created          time.Time      `json:"created"`
 }
 
+// keyCheck makes sure new entries can be encrypted to the keys they are encrypted by
+var keyCheck func(ctx context.Context, entries []Entry) error
+
+// RegisterKeyCheck sets the check that new entries can be encrypted to the keys they are
+// encrypted by, e.g. that the keys havent expired and the entries are encrypted to them.
+// The keystore registers it because vault cant import the keystore.
+func RegisterKeyCheck(check func(ctx context.Context, entries []Entry) error) {
+	keyCheck = check
+}
+
 // PostHandler posts to vault
 func PostHandler(c echo.Context) error {
 	ctx := appengine.NewContext(c.Request())
@@ -49,7 +82,13 @@ func PostHandler(c echo.Context) error {
 	return c.JSON(http.StatusCreated, entries)
 }
 
-// GetAllHandler gets all items from vault
+// GetAllHandler gets all items from vault.
+// Optional query params narrow down the entries:
+// key only gets entries encrypted by that key,
+// prefix only gets entries whose title starts with it,
+// latest=true only gets the latest version of each title,
+// and limit and cursor page through the results. When there may be more
+// results, the cursor for the next page is in the X-Next-Cursor header.
 func GetAllHandler(c echo.Context) error {
 	ctx := appengine.NewContext(c.Request())
 
@@ -58,15 +97,92 @@ func GetAllHandler(c echo.Context) error {
 		return errors.New("Could not get user key from context")
 	}
 
-	entries, err := getAll(ctx, userKey)
+	notModified, err := revisions.CheckETag(c, userKey)
 	if err != nil {
 		return err
 	}
+	if notModified {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	query := datastore.NewQuery(entryEntityType).
+		Ancestor(userKey)
+
+	if c.QueryParam("key") != "" {
+		keyKey, err := datastore.DecodeKey(c.QueryParam("key"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse key")
+		}
+
+		// make sure the user owns the key
+		if !keyKey.Parent().Equal(userKey) {
+			return echo.ErrNotFound
+		}
+
+		query = query.Ancestor(keyKey)
+	}
+
+	if c.QueryParam("latest") == "true" {
+		query = query.Filter("Latest =", true)
+	}
+
+	if prefix := c.QueryParam("prefix"); prefix != "" {
+		query = query.Filter("Title >=", prefix)
+		if end, ok := prefixEnd(prefix); ok {
+			query = query.Filter("Title <", end)
+		}
+		query = query.Order("Title")
+	}
+
+	limit := 0
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+		}
+		query = query.Limit(limit)
+	}
+
+	if c.QueryParam("cursor") != "" {
+		cursor, err := datastore.DecodeCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Unable to parse cursor")
+		}
+		query = query.Start(cursor)
+	}
+
+	entries := []Entry{}
+	it := query.Run(ctx)
+	for {
+		var entry Entry
+		key, err := it.Next(&entry)
+		if err == datastore.Done {
+			break
+		}
+		if err != nil {
+			log.Errorf(ctx, "Unable to list vault: %+v", err)
+			return err
+		}
+
+		entry.Key = key.Parent()
+		entries = append(entries, entry)
+	}
+
+	// a full page means there may be more results
+	if limit > 0 && len(entries) == limit {
+		cursor, err := it.Cursor()
+		if err != nil {
+			log.Errorf(ctx, "Unable to get vault cursor: %+v", err)
+			return err
+		}
+		c.Response().Header().Set(nextCursorHeader, cursor.String())
+	}
 
 	return c.JSON(http.StatusOK, entries)
 }
 
-// DeleteByTitleHandler deletes all entries with a given title
+// DeleteByTitleHandler deletes all entries with a given title.
+// If the query param blind is true, the title is treated as a blind index.
 func DeleteByTitleHandler(c echo.Context) error {
 	ctx := appengine.NewContext(c.Request())
 
@@ -75,22 +191,49 @@ func DeleteByTitleHandler(c echo.Context) error {
 		return errors.New("Could not get user key from context")
 	}
 
-	query := datastore.NewQuery(entryEntityType).
-		Filter("Title =", c.Param("title")).
-		Ancestor(userKey).
-		KeysOnly()
-	keys, err := query.GetAll(ctx, nil)
-	if err != nil {
-		log.Errorf(ctx, "Unable to get keys by title to delete: %+v", err)
-		return err
+	filter := titleFilter
+	if c.QueryParam("blind") == "true" {
+		filter = titleIndexFilter
 	}
 
-	err = datastore.DeleteMulti(ctx, keys)
+	changes := []Change{}
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		query := datastore.NewQuery(entryEntityType).
+			Filter(filter, c.Param("title")).
+			Ancestor(userKey).
+			KeysOnly()
+		keys, err := query.GetAll(tc, nil)
+		if err != nil {
+			log.Errorf(tc, "Unable to get keys by title to delete: %+v", err)
+			return err
+		}
+
+		if len(keys) == 0 {
+			changes = []Change{}
+			return nil
+		}
+
+		err = datastore.DeleteMulti(tc, keys)
+		if err != nil {
+			log.Errorf(tc, "Unable to delete by title: %+v", err)
+			return err
+		}
+
+		deleted := Entry{Title: c.Param("title")}
+		if filter == titleIndexFilter {
+			deleted = Entry{TitleIndex: c.Param("title")}
+		}
+
+		changes = []Change{newChange(deleted, opDeleted)}
+		_, err = recordChanges(tc, changes, userKey)
+		return err
+	}, nil)
 	if err != nil {
-		log.Errorf(ctx, "Unable to delete by title: %+v", err)
 		return err
 	}
 
+	publishChanges(ctx, changes, userKey)
+
 	return c.String(http.StatusOK, c.Param("title"))
 }
 
@@ -102,6 +245,47 @@ func put(ctx context.Context, entries []Entry, userKey *datastore.Key) ([]*datas
 		return nil, errors.New("Cant put no entries")
 	}
 
+	for _, entry := range entries {
+		if err := entry.validateTitle(); err != nil {
+			return nil, err
+		}
+
+		if !entry.Key.Parent().Equal(userKey) {
+			return nil, errors.New("Key must be the id of a key owned by you")
+		}
+	}
+
+	if keyCheck != nil {
+		err := keyCheck(ctx, entries)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// the version bump, latest flags and change feed all read the title, so they are written together
+	var keys []*datastore.Key
+	var changes []Change
+	written := make([]Entry, len(entries))
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		// start over from the request on every attempt
+		copy(written, entries)
+
+		var err error
+		keys, changes, err = putEntries(tc, written, userKey)
+		return err
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	copy(entries, written)
+
+	publishChanges(ctx, changes, userKey)
+
+	return keys, nil
+}
+
+// putEntries does the writes of put. It must be called in a transaction.
+func putEntries(tc context.Context, entries []Entry, userKey *datastore.Key) ([]*datastore.Key, []Change, error) {
 	// check if any version is not defined
 	needsVersionBump := false
 	for _, entry := range entries {
@@ -112,17 +296,17 @@ func put(ctx context.Context, entries []Entry, userKey *datastore.Key) ([]*datas
 
 	if needsVersionBump {
 		// ensure all entries have the same title
-		title := entries[0].Title
+		filter, title := entries[0].titleLookup()
 		for _, entry := range entries {
-			if entry.Title != title {
-				return nil, errors.New("All entries must have the same title")
+			if f, t := entry.titleLookup(); f != filter || t != title {
+				return nil, nil, errors.New("All entries must have the same title")
 			}
 		}
 
 		// get existing entries to bump the version
-		existing, err := GetByTitle(ctx, title, userKey)
+		existing, err := getByTitleLookup(tc, filter, title, userKey)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 
 		// set the next version
@@ -139,28 +323,59 @@ func put(ctx context.Context, entries []Entry, userKey *datastore.Key) ([]*datas
 
 	keys := []*datastore.Key{}
 	for idx := range entries {
-		if !entries[idx].Key.Parent().Equal(userKey) {
-			return nil, errors.New("Key must be the id of a key owned by you")
+		entries[idx].Created = time.Now()
+		keys = append(keys, datastore.NewIncompleteKey(tc, entryEntityType, entries[idx].Key))
+	}
+
+	// work out which titles are new before writing, so the change feed can tell creates from updates
+	changes := []Change{}
+	for _, title := range distinctTitles(entries) {
+		filter, value := title.titleLookup()
+		exists, err := titleExists(tc, filter, value, userKey, nil)
+		if err != nil {
+			return nil, nil, err
 		}
 
-		entries[idx].Created = time.Now()
-		keys = append(keys, datastore.NewIncompleteKey(ctx, entryEntityType, entries[idx].Key))
+		op := opCreated
+		if exists {
+			op = opUpdated
+		}
+		changes = append(changes, newChange(title, op))
+
+		err = markLatest(tc, filter, value, userKey, entries, nil)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	keys, err := datastore.PutMulti(ctx, keys, entries)
+	keys, err := datastore.PutMulti(tc, keys, entries)
 	if err != nil {
-		log.Errorf(ctx, "Error putting to vault: %+v", err)
-		return nil, err
+		log.Errorf(tc, "Error putting to vault: %+v", err)
+		return nil, nil, err
 	}
 
-	return keys, nil
+	_, err = recordChanges(tc, changes, userKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, changes, nil
 }
 
 // GetByTitle gets all vault entries with a given title
 func GetByTitle(ctx context.Context, title string, userKey *datastore.Key) ([]Entry, error) {
+	return getByTitleLookup(ctx, titleFilter, title, userKey)
+}
+
+// GetByTitleIndex gets all vault entries with a given blind index
+func GetByTitleIndex(ctx context.Context, titleIndex string, userKey *datastore.Key) ([]Entry, error) {
+	return getByTitleLookup(ctx, titleIndexFilter, titleIndex, userKey)
+}
+
+func getByTitleLookup(ctx context.Context, filter, title string, userKey *datastore.Key) ([]Entry, error) {
 	entries := []Entry{}
 	query := datastore.NewQuery(entryEntityType).
-		Filter("Title =", title).
+		Filter(filter, title).
 		Ancestor(userKey)
 	keys, err := query.GetAll(ctx, &entries)
 	if err != nil {
@@ -175,6 +390,97 @@ func GetByTitle(ctx context.Context, title string, userKey *datastore.Key) ([]En
 	return entries, nil
 }
 
+// markLatest flags the entries of a title's highest version as the latest, and unflags the rest.
+// Reads in a transaction dont see its own writes, so entries about to be put are passed in
+// and flagged here, and keys deleted earlier in the transaction are passed in to be left out.
+func markLatest(tc context.Context, filter, title string, userKey *datastore.Key, putting []Entry, deleted []*datastore.Key) error {
+	entries := []Entry{}
+	query := datastore.NewQuery(entryEntityType).
+		Filter(filter, title).
+		Ancestor(userKey)
+	keys, err := query.GetAll(tc, &entries)
+	if err != nil {
+		log.Errorf(tc, "Unable to get entries to mark latest: %+v", err)
+		return err
+	}
+
+	latestVersion := 0
+	for idx, entry := range entries {
+		if !containsKey(deleted, keys[idx]) && entry.Version > latestVersion {
+			latestVersion = entry.Version
+		}
+	}
+	for _, entry := range putting {
+		if f, t := entry.titleLookup(); f == filter && t == title && entry.Version > latestVersion {
+			latestVersion = entry.Version
+		}
+	}
+
+	for idx := range putting {
+		if f, t := putting[idx].titleLookup(); f == filter && t == title {
+			putting[idx].Latest = putting[idx].Version == latestVersion
+		}
+	}
+
+	changedKeys := []*datastore.Key{}
+	changed := []Entry{}
+	for idx := range entries {
+		if containsKey(deleted, keys[idx]) {
+			continue
+		}
+
+		latest := entries[idx].Version == latestVersion
+		if entries[idx].Latest != latest {
+			entries[idx].Latest = latest
+			changedKeys = append(changedKeys, keys[idx])
+			changed = append(changed, entries[idx])
+		}
+	}
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	_, err = datastore.PutMulti(tc, changedKeys, changed)
+	if err != nil {
+		log.Errorf(tc, "Unable to mark latest entries: %+v", err)
+		return err
+	}
+
+	return nil
+}
+
+// titleExists checks if a title has any entries, other than the deleted ones
+func titleExists(ctx context.Context, filter, title string, userKey *datastore.Key, deleted []*datastore.Key) (bool, error) {
+	query := datastore.NewQuery(entryEntityType).
+		Filter(filter, title).
+		Ancestor(userKey).
+		KeysOnly().
+		Limit(len(deleted) + 1)
+	keys, err := query.GetAll(ctx, nil)
+	if err != nil {
+		log.Errorf(ctx, "Unable to check if title exists: %+v", err)
+		return false, err
+	}
+
+	for _, key := range keys {
+		if !containsKey(deleted, key) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func containsKey(keys []*datastore.Key, key *datastore.Key) bool {
+	for _, k := range keys {
+		if k.Equal(key) {
+			return true
+		}
+	}
+	return false
+}
+
 func getAll(ctx context.Context, userKey *datastore.Key) ([]Entry, error) {
 	entries := []Entry{}
 	query := datastore.NewQuery(entryEntityType).
@@ -194,20 +500,179 @@ func getAll(ctx context.Context, userKey *datastore.Key) ([]Entry, error) {
 
 // DeleteByKey deletes all entries encrypted by a specific key
 func DeleteByKey(ctx context.Context, key *datastore.Key) error {
-	query := datastore.NewQuery(entryEntityType).
-		KeysOnly().
-		Ancestor(key)
-	keys, err := query.GetAll(ctx, nil)
+	var changes []Change
+	err := datastore.RunInTransaction(ctx, func(tc context.Context) error {
+		entries := []Entry{}
+		query := datastore.NewQuery(entryEntityType).
+			Ancestor(key)
+		keys, err := query.GetAll(tc, &entries)
+		if err != nil {
+			log.Errorf(tc, "Unable to get all vault entries by key: %+v", err)
+			return err
+		}
+
+		err = datastore.DeleteMulti(tc, keys)
+		if err != nil {
+			log.Errorf(tc, "Unable to delete all vault entries by key: %+v", err)
+			return err
+		}
+
+		// titles that are still encrypted by other keys were only updated
+		changes = []Change{}
+		for _, title := range distinctTitles(entries) {
+			filter, value := title.titleLookup()
+			exists, err := titleExists(tc, filter, value, key.Parent(), keys)
+			if err != nil {
+				return err
+			}
+
+			op := opDeleted
+			if exists {
+				op = opUpdated
+
+				// the deleted entries may have been the latest version
+				err = markLatest(tc, filter, value, key.Parent(), nil, keys)
+				if err != nil {
+					return err
+				}
+			}
+			changes = append(changes, newChange(title, op))
+		}
+
+		_, err = recordChanges(tc, changes, key.Parent())
+		return err
+	}, nil)
 	if err != nil {
-		log.Errorf(ctx, "Unable to get all vault entries by key: %+v", err)
 		return err
 	}
 
-	err = datastore.DeleteMulti(ctx, keys)
+	publishChanges(ctx, changes, key.Parent())
+
+	return nil
+}
+
+// Usage is how much of the vault a key encrypts
+type Usage struct {
+	Titles        int       `json:"titles"`
+	Entries       int       `json:"entries"`
+	LatestEntryAt time.Time `json:"latestEntryAt"` // zero if the key encrypts no entries
+}
+
+// UsageByKey counts the entries and titles encrypted by each of a users keys, by encoded key.
+// Only titles and created times are read, with projection queries.
+func UsageByKey(ctx context.Context, userKey *datastore.Key) (map[string]Usage, error) {
+	entries := []Entry{}
+	keys, err := datastore.NewQuery(entryEntityType).
+		Ancestor(userKey).
+		Project("Title", "Created").
+		GetAll(ctx, &entries)
 	if err != nil {
-		log.Errorf(ctx, "Unable to delete all vault entries by key: %+v", err)
-		return err
+		log.Errorf(ctx, "Unable to get vault entries for key usage: %+v", err)
+		return nil, err
+	}
+
+	// entries from before blind indexes existed dont have one, so they are projected separately
+	indexed := []Entry{}
+	indexedKeys, err := datastore.NewQuery(entryEntityType).
+		Ancestor(userKey).
+		Project("TitleIndex").
+		GetAll(ctx, &indexed)
+	if err != nil {
+		log.Errorf(ctx, "Unable to get vault title indexes for key usage: %+v", err)
+		return nil, err
+	}
+
+	titleIndexes := map[string]string{}
+	for idx, key := range indexedKeys {
+		titleIndexes[key.Encode()] = indexed[idx].TitleIndex
+	}
+
+	usages := map[string]Usage{}
+	titles := map[string]bool{}
+	for idx, key := range keys {
+		entry := entries[idx]
+		entry.TitleIndex = titleIndexes[key.Encode()]
+
+		id := key.Parent().Encode()
+		usage := usages[id]
+		usage.Entries++
+
+		filter, value := entry.titleLookup()
+		if !titles[id+filter+value] {
+			titles[id+filter+value] = true
+			usage.Titles++
+		}
+
+		if entry.Created.After(usage.LatestEntryAt) {
+			usage.LatestEntryAt = entry.Created
+		}
+		usages[id] = usage
+	}
+
+	return usages, nil
+}
+
+// titleLookup returns the filter and value that find every version of an entry's title
+func (e Entry) titleLookup() (string, string) {
+	if e.TitleIndex != "" {
+		return titleIndexFilter, e.TitleIndex
+	}
+	return titleFilter, e.Title
+}
+
+// distinctTitles returns an entry with just the title set for each distinct title in entries
+func distinctTitles(entries []Entry) []Entry {
+	titles := []Entry{}
+	seen := map[string]bool{}
+	for _, entry := range entries {
+		filter, value := entry.titleLookup()
+		if seen[filter+value] {
+			continue
+		}
+		seen[filter+value] = true
+		titles = append(titles, Entry{Title: entry.Title, TitleIndex: entry.TitleIndex})
+	}
+	return titles
+}
+
+// validateTitle makes sure an entry has exactly one of a plaintext title or a blind index,
+// and that blind indexes come with an encrypted title
+func (e Entry) validateTitle() error {
+	if (e.Title != "" && e.TitleIndex != "") || (e.Title == "" && e.TitleIndex == "") {
+		return echo.NewHTTPError(http.StatusBadRequest, "Only one of title and titleIndex should be provided")
+	}
+
+	if e.TitleIndex == "" {
+		return nil
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(e.TitleIndex)
+	if err != nil || len(decoded) != blindIndexSize {
+		return echo.NewHTTPError(http.StatusBadRequest, "titleIndex must be an unpadded base64url encoded HMAC-SHA256")
+	}
+
+	if e.EncryptedTitle == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "Entries with a titleIndex must have an encryptedTitle")
+	}
+
+	_, err = armor.Decode(strings.NewReader(e.EncryptedTitle))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "The provided encrypted title is not valid")
 	}
 
 	return nil
 }
+
+// prefixEnd gets the first string after every string that starts with a prefix. The datastore
+// compares strings byte by byte, so it's the prefix up to its last byte below 0xff, with that
+// byte incremented. A prefix of only 0xff bytes has no end.
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}